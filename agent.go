@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// agentHTTPClient pushes the agent's reports
+var agentHTTPClient = &http.Client{Timeout: time.Minute}
+
+// agent runs on a hypervisor and pushes the list of its domains to the
+// report endpoint of a server.  The domains are listed by running command,
+// or over the libvirt socket if libvirt is set.  A report is only pushed
+// when the domains have changed since the last one, or the heartbeat has
+// passed, so the server's copy stays fresh.
+type agent struct {
+	server    string
+	host      string
+	token     string
+	command   string
+	libvirt   *url.URL
+	timeout   time.Duration
+	heartbeat time.Duration
+	retries   int
+	backoff   time.Duration
+
+	last     *libvirtHost
+	lastSent time.Time
+}
+
+// newAgent creates an agent reporting as host to a server, given as
+// host:port or a URL.  The domains are listed with the libvirt URI if it
+// is given, and with the command otherwise.
+func newAgent(server, host, token, command, libvirtURI string, timeout time.Duration) (*agent, error) {
+	if server == "" {
+		return nil, fmt.Errorf("No server to report to")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("No report token")
+	}
+	a := &agent{
+		server:    server,
+		host:      host,
+		token:     token,
+		command:   command,
+		timeout:   timeout,
+		heartbeat: AgentHeartbeat * time.Minute,
+		retries:   AgentRetries,
+		backoff:   AgentBackoff * time.Second,
+	}
+	if libvirtURI != "" {
+		src, err := newLibvirtSource(libvirtURI)
+		if err != nil {
+			return nil, err
+		}
+		uris := src.(*libvirtSource).uris
+		if len(uris) != 1 {
+			return nil, fmt.Errorf("Bad libvirt URI, the agent takes one: %s", libvirtURI)
+		}
+		a.libvirt = uris[0]
+	}
+	if a.host == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		a.host = name
+	}
+	return a, nil
+}
+
+// gather lists the local domains.  A failure to list them is
+// itself reported, as the host's status and error.
+func (a *agent) gather() libvirtHost {
+	var h libvirtHost
+	if a.libvirt != nil {
+		l := &libvirtSource{timeout: a.timeout}
+		h = l.fetchHost(a.libvirt)
+	} else {
+		h = a.runCommand()
+	}
+	h.Name = a.host
+	// The host is up, as it's reporting
+	if h.Status != "" {
+		h.Status = HostCommandFailed
+	}
+	sort.Slice(h.Domains, func(i, j int) bool { return h.Domains[i].Name < h.Domains[j].Name })
+	return h
+}
+
+// runCommand lists the local domains with the agent's command
+func (a *agent) runCommand() libvirtHost {
+	r := runCommand(a.command, a.timeout)
+	if r.Failed || r.Unreachable {
+		msg := strings.TrimSpace(r.Stderr)
+		if msg == "" {
+			msg = r.Msg
+		}
+		return libvirtHost{Status: HostCommandFailed, Error: msg}
+	}
+	h, err := parseReport(a.host, "", []byte(r.Stdout))
+	if err != nil {
+		return libvirtHost{Status: HostCommandFailed, Error: err.Error()}
+	}
+	return h
+}
+
+// report gathers the domains and pushes them if they have changed
+// or the heartbeat has passed
+func (a *agent) report() error {
+	h := a.gather()
+	if a.last != nil && reflect.DeepEqual(*a.last, h) && time.Since(a.lastSent) < a.heartbeat {
+		return nil
+	}
+	if a.last != nil {
+		added, removed, changed := diffDomains(a.last.Domains, h.Domains)
+		log.Printf("Reporting %d domains, added: %v, removed: %v, changed: %v", len(h.Domains), added, removed, changed)
+	} else {
+		log.Printf("Reporting %d domains", len(h.Domains))
+	}
+	if h.Status != "" {
+		log.Printf("Reporting %s: %s", h.Status, h.Error)
+	}
+	if err := a.push(h); err != nil {
+		return err
+	}
+	a.last, a.lastSent = &h, time.Now()
+	return nil
+}
+
+// push sends a report to the server, retrying with exponential backoff.
+// Requests the server rejects as bad aren't retried.
+func (a *agent) push(h libvirtHost) error {
+	body, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	u := serverURL(a.server) + HostsPrefix + url.PathEscape(a.host) + "/report"
+	delay := a.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := a.post(u, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= a.retries {
+			return err
+		}
+		log.Printf("Report failed, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post makes one attempt at pushing a report, returning
+// whether it is worth retrying if it fails
+func (a *agent) post(u string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	resp, err := agentHTTPClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+	raw, _ := ioutil.ReadAll(resp.Body)
+	var data struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(raw, &data) != nil || data.Error == "" {
+		data.Error = resp.Status
+	}
+	err = fmt.Errorf("Report rejected by %s: %s", a.server, data.Error)
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
+
+// run reports every interval until done is closed
+func (a *agent) run(interval time.Duration, done chan struct{}) {
+	var delay time.Duration
+	for {
+		select {
+		case <-time.After(delay):
+			if err := a.report(); err != nil {
+				log.Printf("Problem reporting: %v", err)
+			}
+			delay = interval
+		case <-done:
+			return
+		}
+	}
+}
+
+// diffDomains returns the names of the domains added, removed
+// and changed in any way between two lists sorted by name
+func diffDomains(old, new []libvirtDomain) (added, removed, changed []string) {
+	was := make(map[string]libvirtDomain, len(old))
+	for _, d := range old {
+		was[d.Name] = d
+	}
+	for _, d := range new {
+		o, ok := was[d.Name]
+		switch {
+		case !ok:
+			added = append(added, d.Name)
+		case o != d:
+			changed = append(changed, d.Name)
+		}
+		delete(was, d.Name)
+	}
+	for _, d := range old {
+		if _, ok := was[d.Name]; ok {
+			removed = append(removed, d.Name)
+		}
+	}
+	return added, removed, changed
+}
+
+// serverURL returns the base URL of a server given as host:port or a URL
+func serverURL(server string) string {
+	if strings.HasPrefix(server, "http://") || strings.HasPrefix(server, "https://") {
+		return strings.TrimRight(server, "/")
+	}
+	return "http://" + server
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffDomains(t *testing.T) {
+	old := []libvirtDomain{
+		{Name: "olh", State: GuestShutOff},
+		{Name: "tam", State: GuestRunning},
+		{Name: "wiki", State: GuestRunning},
+	}
+	new := []libvirtDomain{
+		{Name: "compute-64", State: GuestPaused},
+		{Name: "olh", State: GuestShutOff},
+		{Name: "tam", State: GuestPaused},
+	}
+	added, removed, changed := diffDomains(old, new)
+	got := [][]string{added, removed, changed}
+	expected := [][]string{{"compute-64"}, {"wiki"}, {"tam"}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", got, expected)
+	}
+}
+
+func TestNewAgent(t *testing.T) {
+	tests := []struct {
+		server, token, libvirt string
+		err                    string
+	}{
+		{"localhost:7474", "secret", "", ""},
+		{"localhost:7474", "secret", "qemu:///system", ""},
+		{"", "secret", "", "No server to report to"},
+		{"localhost:7474", "", "", "No report token"},
+		{"localhost:7474", "secret", "qemu:///system,qemu:///session", "Bad libvirt URI, the agent takes one: qemu:///system,qemu:///session"},
+		{"localhost:7474", "secret", "qemu+tls://kvm09.example.com/system", "Bad libvirt URI, unsupported transport: qemu+tls://kvm09.example.com/system"},
+	}
+	for _, test := range tests {
+		a, err := newAgent(test.server, "kvm09.example.com", test.token, AgentCommand, test.libvirt, time.Second)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("Got error %v, expected %s", err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newAgent() returned an error unexpectedly: %v", err)
+			continue
+		}
+		if (a.libvirt != nil) != (test.libvirt != "") {
+			t.Errorf("Got libvirt URI %v, expected %s", a.libvirt, test.libvirt)
+		}
+	}
+}
+
+func TestAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	list := filepath.Join(dir, "list")
+	virsh := " Id    Name                           State\n" +
+		"----------------------------------------------------\n" +
+		" 4     tam                            running\n" +
+		" -     olh                            shut off\n"
+	if err := ioutil.WriteFile(list, []byte(virsh), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newServer(nil, nil)
+	s.reportTokens = []string{"secret"}
+	pushes := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes++
+		s.handleHosts(w, r)
+	}))
+	defer ts.Close()
+
+	a, err := newAgent(ts.URL, "kvm09.example.com", "secret", "cat "+list, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(step string, expectedPushes int, expected map[string]VGuest) {
+		if err := a.report(); err != nil {
+			t.Errorf("%s: report() returned an error unexpectedly: %v", step, err)
+		}
+		if pushes != expectedPushes {
+			t.Errorf("%s: got %d pushes, expected %d", step, pushes, expectedPushes)
+		}
+		guests := make(map[string]VGuest)
+		for name, g := range s.svmap.Guests {
+			guests[name] = VGuest{State: g.State, Host: g.Host}
+		}
+		if !reflect.DeepEqual(guests, expected) {
+			t.Errorf("%s: Got:\n%#v\nExpected:\n%#v", step, guests, expected)
+		}
+	}
+	check("first report", 1, map[string]VGuest{
+		"tam": {State: GuestRunning, Host: "kvm09.example.com"},
+		"olh": {State: GuestShutOff, Host: "kvm09.example.com"},
+	})
+	check("unchanged", 1, map[string]VGuest{
+		"tam": {State: GuestRunning, Host: "kvm09.example.com"},
+		"olh": {State: GuestShutOff, Host: "kvm09.example.com"},
+	})
+
+	a.heartbeat = 0
+	check("heartbeat", 2, map[string]VGuest{
+		"tam": {State: GuestRunning, Host: "kvm09.example.com"},
+		"olh": {State: GuestShutOff, Host: "kvm09.example.com"},
+	})
+	a.heartbeat = time.Hour
+
+	virsh = strings.Replace(virsh, "running", "paused ", 1)
+	if err := ioutil.WriteFile(list, []byte(virsh), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check("changed", 3, map[string]VGuest{
+		"tam": {State: GuestPaused, Host: "kvm09.example.com"},
+		"olh": {State: GuestShutOff, Host: "kvm09.example.com"},
+	})
+
+	a.command = `sh -c "echo 'error: failed to connect to the hypervisor' >&2; exit 1"`
+	check("failed", 4, map[string]VGuest{})
+	host := s.svmap.Hosts["kvm09.example.com"]
+	if host.Status != HostCommandFailed || host.Error != "error: failed to connect to the hypervisor" {
+		t.Errorf("Got host status %s and error %q, expected %s", host.Status, host.Error, HostCommandFailed)
+	}
+
+	a.token = "wrong"
+	a.heartbeat = 0
+	if err := a.report(); err == nil || err.Error() != "Report rejected by "+ts.URL+": Unauthorized" {
+		t.Errorf("Got error %v, expected the report to be rejected", err)
+	}
+	if pushes != 5 {
+		t.Errorf("Got %d pushes, expected the rejected push not to be retried", pushes)
+	}
+}
+
+func TestAgentRetry(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	a, err := newAgent(ts.URL, "kvm09.example.com", "secret", "true", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.backoff = time.Millisecond
+	if err := a.report(); err != nil {
+		t.Errorf("report() returned an error unexpectedly: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Got %d attempts, expected 3", attempts)
+	}
+
+	attempts = -10
+	a.retries = 2
+	a.heartbeat = 0
+	if err := a.report(); err == nil || err.Error() != "Report rejected by "+ts.URL+": 503 Service Unavailable" {
+		t.Errorf("Got error %v, expected the report to fail", err)
+	}
+	if attempts != -7 {
+		t.Errorf("Got %d attempts, expected 3", attempts+10)
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// maxLineLength is the longest line of Ansible output which can be parsed.
+// In one-line mode the whole "virsh list" output of a host is on one line.
+const maxLineLength = 64 * 1024 * 1024
+
+// ParseAnsibleOutput parses the output of an Ansible run of
+// "virsh list --all" on all the virtual hosts.  The format is detected
+// automatically: the default ad-hoc text output, one-line (-o) output,
+// or the json / ansible.posix.json stdout callbacks.
+func ParseAnsibleOutput(ansibleOutput []byte) (*Vmap, error) {
+	v, _, err := ParseAnsibleOutputWithDiagnostics(ansibleOutput)
+	return v, err
+}
+
+// ParseAnsibleOutputWithDiagnostics is ParseAnsibleOutput which also returns
+// Diagnostics for the parts of the output which were skipped or suspicious.
+func ParseAnsibleOutputWithDiagnostics(ansibleOutput []byte) (*Vmap, []Diagnostic, error) {
+	return ParseAnsibleReader(bytes.NewReader(ansibleOutput))
+}
+
+// ParseAnsibleReader is the streaming form of ParseAnsibleOutputWithDiagnostics.
+// The output is read from r a line, or for JSON a host, at a time, so only
+// the resulting Vmap is held in memory rather than the whole of the output.
+func ParseAnsibleReader(r io.Reader) (*Vmap, []Diagnostic, error) {
+	p := newAnsibleParser()
+	br := bufio.NewReader(r)
+	var err error
+	if isJSONOutput(br) {
+		err = p.parseJSON(br)
+	} else {
+		err = p.parseText(br)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.SliceStable(p.diags, func(i, j int) bool { return p.diags[i].Line < p.diags[j].Line })
+	return p.v, p.diags, nil
+}
+
+// isJSONOutput reports whether the Ansible output came from a JSON
+// stdout callback, peeking past any leading white space
+func isJSONOutput(br *bufio.Reader) bool {
+	for n := 1; n <= br.Size(); n++ {
+		b, _ := br.Peek(n)
+		if len(b) < n {
+			return false
+		}
+		switch b[n-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '{':
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+// hostErrors are the fragments of Ansible error messages which
+// identify why a host couldn't be reached, in order of priority
+var hostErrors = []struct {
+	status    HostStatus
+	fragments []string
+}{
+	{HostUnreachableDNS, []string{
+		"Name or service not known",
+		"Could not resolve hostname",
+		"nodename nor servname provided",
+		"Temporary failure in name resolution",
+		"No address associated with hostname",
+		"no such host",
+	}},
+	{HostTimeout, []string{"timed out", "Timeout", "timeout"}},
+	{HostAuthFailed, []string{
+		"Permission denied",
+		"Authentication failed",
+		"Host key verification failed",
+		"Invalid/incorrect password",
+		"Incorrect sudo password",
+		"authentication failed",
+		"authentication required",
+	}},
+}
+
+// classifyHostError determines the status of a host from an Ansible error message
+func classifyHostError(msg string) HostStatus {
+	for _, e := range hostErrors {
+		for _, f := range e.fragments {
+			if strings.Contains(msg, f) {
+				return e.status
+			}
+		}
+	}
+	return HostUnknown
+}
+
+// parseStatusLine parses an Ansible status line such as
+// "kvm09.example.com | CHANGED | rc=0 >>" or
+// "kvm30.example.com | FAILED => FAILED: timed out"
+// into the host name, its status and any error message.
+// A JSON body following the marker is left to the caller.
+func parseStatusLine(line string) (name string, status HostStatus, msg string) {
+	parts := strings.Split(line, " | ")
+	name = strings.TrimSpace(parts[0])
+	for _, p := range parts[1:] {
+		p = strings.TrimSuffix(strings.TrimSpace(p), " >>")
+		if strings.HasPrefix(p, "rc=") && p != "rc=0" {
+			return name, HostCommandFailed, "non-zero return code (" + p + ")"
+		}
+	}
+	rest := strings.TrimSpace(strings.Join(parts[1:], " | "))
+	marker, detail := rest, ""
+	if i := strings.IndexAny(rest, " :"); i >= 0 {
+		marker, detail = rest[:i], rest[i+1:]
+	}
+	switch marker {
+	case "success", "SUCCESS", "CHANGED":
+		return name, HostUp, ""
+	}
+	for _, arrow := range []string{"=>", ">>"} {
+		detail = strings.TrimPrefix(strings.TrimSpace(detail), arrow)
+	}
+	msg = strings.TrimSpace(detail)
+	return name, classifyHostError(msg), msg
+}
+
+// jsonResultStart returns the offset of a JSON result following the
+// marker of a status line, e.g. "kvm30.example.com | UNREACHABLE! => {"
+// in Ansible 2 or "kvm12.example.com | FAILED >> {" in Ansible 1
+func jsonResultStart(line string) (int, bool) {
+	for _, arrow := range []string{" => {", " >> {"} {
+		if i := strings.Index(line, arrow); i >= 0 {
+			return i + len(arrow) - 1, true
+		}
+	}
+	return 0, false
+}
+
+// isAnsibleMessage reports whether line is a message from Ansible itself,
+// such as a warning about Python interpreter discovery
+func isAnsibleMessage(line string) bool {
+	for _, prefix := range []string{"[WARNING]", "[DEPRECATION WARNING]", "[ERROR]"} {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonResultStatus determines the status of a host from its JSON result.
+// The error output of a failed command or module is preferred to its message.
+func jsonResultStatus(h ansibleJSONHost) (HostStatus, string) {
+	msg := strings.TrimSpace(h.Msg)
+	switch {
+	case h.Unreachable:
+		return classifyHostError(msg), msg
+	case h.Failed && h.Rc != 0:
+		for _, stderr := range []string{h.Stderr, h.ModuleStderr} {
+			if stderr = strings.TrimSpace(stderr); stderr != "" {
+				return HostCommandFailed, stderr
+			}
+		}
+		return HostCommandFailed, msg
+	case h.Failed:
+		return classifyHostError(msg), msg
+	}
+	return HostUp, ""
+}
+
+// jsonResult accumulates the lines of a JSON result printed after a
+// status line, until its braces balance
+type jsonResult struct {
+	name   string
+	status HostStatus
+	line   int
+	text   string
+	body   strings.Builder
+	depth  int
+	inStr  bool
+	escape bool
+}
+
+// add adds a line of the JSON result, reporting whether it is complete
+func (j *jsonResult) add(line string) bool {
+	j.body.WriteString(line)
+	j.body.WriteByte('\n')
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case j.escape:
+			j.escape = false
+		case j.inStr && c == '\\':
+			j.escape = true
+		case c == '"':
+			j.inStr = !j.inStr
+		case j.inStr:
+		case c == '{':
+			j.depth++
+		case c == '}':
+			j.depth--
+		}
+	}
+	return j.depth <= 0
+}
+
+// hostStatusDiagnostic returns a warning for a host which isn't up
+func hostStatusDiagnostic(name string, status HostStatus, line int, text string) (Diagnostic, bool) {
+	if status == HostUp {
+		return Diagnostic{}, false
+	}
+	return Diagnostic{
+		Line:     line,
+		Text:     text,
+		Reason:   fmt.Sprintf("host %s %s, its guests are missing", name, status.Description()),
+		Severity: SeverityWarning,
+	}, true
+}
+
+// ansibleParser builds a Vmap from Ansible output as it is read.
+// host is the host whose "virsh list" output is being read, if any,
+// and result is a JSON result which is still being read.
+type ansibleParser struct {
+	v      *Vmap
+	diags  []Diagnostic
+	host   *hostParser
+	result *jsonResult
+}
+
+func newAnsibleParser() *ansibleParser {
+	return &ansibleParser{
+		v: &Vmap{
+			Hosts:  make(map[string]VHost),
+			Guests: make(map[string]VGuest),
+		},
+	}
+}
+
+// hostParser holds the state of one host while its output is read.
+// errLines is the error output of a host whose command failed.
+type hostParser struct {
+	name     string
+	status   HostStatus
+	msg      string
+	virsh    virshListParser
+	guests   []string
+	errLines []string
+}
+
+// startHost finishes the current host and starts reading the output of another
+func (p *ansibleParser) startHost(name string, status HostStatus, msg string) {
+	p.endHost()
+	p.host = &hostParser{name: name, status: status, msg: msg}
+}
+
+// endHost adds the current host to the map
+func (p *ansibleParser) endHost() {
+	h := p.host
+	if h == nil {
+		return
+	}
+	sort.Strings(h.guests)
+	host := VHost{State: h.status.State(), Guests: h.guests}
+	if h.status != HostUp {
+		// The error output of a failed command says more than its return
+		// code, other errors may continue on the following lines
+		host.Status, host.Error = h.status, h.msg
+		if h.status == HostCommandFailed && len(h.errLines) > 0 {
+			host.Error = strings.Join(h.errLines, "\n")
+		} else if len(h.errLines) > 0 {
+			host.Error = strings.Join(append([]string{h.msg}, h.errLines...), "\n")
+		}
+	}
+	p.v.Hosts[h.name] = host
+	p.host = nil
+}
+
+// virshLine parses a line of the current host's "virsh list --all" output.
+// Diagnostics are recorded for lines which couldn't be parsed.
+func (p *ansibleParser) virshLine(lineNo int, line string) {
+	h := p.host
+	d, kind := h.virsh.parseLine(line)
+	switch kind {
+	case virshSkipped:
+		return
+	case virshUnrecognized:
+		if h.status != HostUp {
+			h.errLines = append(h.errLines, strings.TrimSpace(line))
+			return
+		}
+		p.diags = append(p.diags, Diagnostic{
+			Line:     lineNo,
+			Text:     line,
+			Reason:   fmt.Sprintf("unrecognized line in the virsh output of host %s", h.name),
+			Severity: SeverityError,
+		})
+		return
+	}
+	p.addGuest(lineNo, line, d.Name, d.State)
+}
+
+// addGuest adds a guest of the current host to the map.  Diagnostics are
+// recorded for unknown guest states and guests which are already in the map.
+func (p *ansibleParser) addGuest(lineNo int, text string, name string, state GuestState) {
+	h := p.host
+	if !state.Known() {
+		p.diags = append(p.diags, Diagnostic{
+			Line:     lineNo,
+			Text:     text,
+			Reason:   fmt.Sprintf("unknown state %q for guest %s", state, name),
+			Severity: SeverityWarning,
+		})
+	}
+	h.guests = append(h.guests, name)
+	g, ok := p.v.Guests[name]
+	if !ok {
+		p.v.Guests[name] = VGuest{State: state, Host: h.name}
+		return
+	}
+	others := g.placements()
+	g.addPlacement(Placement{Host: h.name, State: state})
+	p.v.Guests[name] = g
+	diag := Diagnostic{
+		Line:     lineNo,
+		Text:     text,
+		Reason:   fmt.Sprintf("guest %s on host %s is also defined on host %s", name, h.name, others[0].Host),
+		Severity: SeverityWarning,
+	}
+	if g.SplitBrain {
+		diag.Reason = fmt.Sprintf("guest %s is running on more than one host: %s", name, strings.Join(g.runningHosts(), ", "))
+		diag.Severity = SeverityError
+	}
+	p.diags = append(p.diags, diag)
+}
+
+// parseText parses the ad-hoc text output of Ansible, both the default
+// multi-line format and the one-line (-o) format.
+func (p *ansibleParser) parseText(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineLength)
+	n := 0
+	message := false
+	for scanner.Scan() {
+		n++
+		line := scanner.Text()
+		if p.result != nil {
+			if p.result.add(line) {
+				p.endResult()
+			}
+			continue
+		}
+		// Messages from Ansible may be wrapped onto several lines
+		if isAnsibleMessage(line) {
+			p.diags = append(p.diags, Diagnostic{
+				Line:     n,
+				Text:     line,
+				Reason:   "message from Ansible",
+				Severity: SeverityWarning,
+			})
+			message = true
+			continue
+		}
+		if message && strings.TrimSpace(line) != "" && !strings.Contains(line, " | ") {
+			continue
+		}
+		message = false
+		// Ansible status lines contain the hostname and any connection errors
+		if strings.Contains(line, " | ") {
+			if i, ok := jsonResultStart(line); ok {
+				p.endHost()
+				name, status, _ := parseStatusLine(line[:i])
+				p.result = &jsonResult{name: name, status: status, line: n, text: line}
+				if p.result.add(line[i:]) {
+					p.endResult()
+				}
+				continue
+			}
+			name, status, msg := parseStatusLine(line)
+			if d, bad := hostStatusDiagnostic(name, status, n, line); bad {
+				p.diags = append(p.diags, d)
+			}
+			p.startHost(name, status, msg)
+			// One-line mode puts the escaped command output on the status
+			// line, older versions separated the stderr with a pipe
+			out, stderr := "", ""
+			if i := strings.Index(line, " | (stdout) "); i >= 0 {
+				out = line[i+len(" | (stdout) "):]
+			}
+			for _, sep := range []string{" | (stderr) ", " (stderr) "} {
+				if j := strings.Index(out, sep); j >= 0 {
+					out, stderr = out[:j], out[j+len(sep):]
+					break
+				}
+			}
+			if out != "" {
+				for _, l := range strings.Split(out, `\n`) {
+					p.virshLine(n, l)
+				}
+			}
+			if stderr != "" && status == HostCommandFailed {
+				p.host.errLines = strings.Split(stderr, `\n`)
+			}
+			continue
+		}
+		if p.host != nil {
+			p.virshLine(n, line)
+		} else if strings.TrimSpace(line) != "" {
+			p.diags = append(p.diags, Diagnostic{
+				Line:     n,
+				Text:     line,
+				Reason:   "unrecognized line outside of any host's output",
+				Severity: SeverityWarning,
+			})
+		}
+	}
+	if p.result != nil {
+		p.endResult()
+	}
+	p.endHost()
+	return scanner.Err()
+}
+
+// endResult adds the host of the JSON result which has been read.
+// The marker of the status line says whether the host failed when
+// the result doesn't.
+func (p *ansibleParser) endResult() {
+	r := p.result
+	p.result = nil
+	var h ansibleJSONHost
+	if err := json.Unmarshal([]byte(r.body.String()), &h); err != nil {
+		p.diags = append(p.diags, Diagnostic{
+			Line:     r.line,
+			Text:     r.text,
+			Reason:   fmt.Sprintf("bad JSON result of host %s: %v", r.name, err),
+			Severity: SeverityError,
+		})
+		h = ansibleJSONHost{Msg: strings.TrimSpace(r.body.String())}
+	}
+	if r.status != HostUp && !h.Unreachable {
+		h.Failed = true
+	}
+	p.hostResult(r.name, h, r.line, r.text)
+}
+
+// ansibleJSONOutput is the document written by the json and
+// ansible.posix.json stdout callbacks
+type ansibleJSONOutput struct {
+	Plays []ansibleJSONPlay `json:"plays"`
+}
+
+type ansibleJSONPlay struct {
+	Tasks []ansibleJSONTask `json:"tasks"`
+}
+
+type ansibleJSONTask struct {
+	Hosts map[string]ansibleJSONHost `json:"hosts"`
+}
+
+// ansibleJSONHost is the result of a task on one host.  It is also the
+// content of the per-host files written by "ansible --tree".
+type ansibleJSONHost struct {
+	Stdout       string `json:"stdout"`
+	Stderr       string `json:"stderr,omitempty"`
+	ModuleStderr string `json:"module_stderr,omitempty"`
+	Msg          string `json:"msg,omitempty"`
+	Rc           int    `json:"rc,omitempty"`
+	Failed       bool   `json:"failed,omitempty"`
+	Unreachable  bool   `json:"unreachable,omitempty"`
+}
+
+// ansibleJSONHostsPath is the path of the host results in the JSON document,
+// with "" standing for the elements of an array
+var ansibleJSONHostsPath = []string{"plays", "", "tasks", "", "hosts"}
+
+// parseJSON parses the output of the json stdout callback.  The document is
+// walked token by token and each host's result is decoded on its own.
+func (p *ansibleParser) parseJSON(r io.Reader) error {
+	return p.walkJSON(json.NewDecoder(r), nil)
+}
+
+// walkJSON reads the next value from dec.  path holds the keys of the
+// enclosing objects, with "" for the elements of arrays.
+func (p *ansibleParser) walkJSON(dec *json.Decoder, path []string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return nil
+	}
+	hosts := delim == '{' && equalPaths(path, ansibleJSONHostsPath)
+	for dec.More() {
+		key := ""
+		if delim == '{' {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key = tok.(string)
+		}
+		if hosts {
+			var h ansibleJSONHost
+			if err := dec.Decode(&h); err != nil {
+				return err
+			}
+			p.jsonHost(key, h)
+			continue
+		}
+		if err := p.walkJSON(dec, append(path, key)); err != nil {
+			return err
+		}
+	}
+	// The closing delimiter
+	_, err = dec.Token()
+	return err
+}
+
+// jsonHost adds the result of a host from the JSON output
+func (p *ansibleParser) jsonHost(name string, h ansibleJSONHost) {
+	p.hostResult(name, h, 0, h.Msg)
+}
+
+// hostResult adds a host from its JSON result.  line and text are
+// those of the result in the output, for the Diagnostics.
+func (p *ansibleParser) hostResult(name string, h ansibleJSONHost, line int, text string) {
+	status, msg := jsonResultStatus(h)
+	if d, bad := hostStatusDiagnostic(name, status, line, text); bad {
+		p.diags = append(p.diags, d)
+	}
+	p.startHost(name, status, msg)
+	for _, l := range strings.Split(h.Stdout, "\n") {
+		p.virshLine(line, l)
+	}
+	p.endHost()
+}
+
+// equalPaths reports whether two JSON paths are the same
+func equalPaths(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
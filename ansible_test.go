@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var ansibleOnelineOutput = []byte(`kvm21.example.com | FAILED => FAILED: [Errno -2] Name or service not known
+kvm09.example.com | success | rc=0 | (stdout)  Id    Name                           State\n----------------------------------------------------\n 4     tam                            running\n -     olh                            shut off\n
+kvm43.example.com | CHANGED | rc=0 | (stdout)  Id    Name                           State\n----------------------------------------------------\n 99    compute-64                     paused\n
+kvm30.example.com | FAILED => FAILED: timed out
+kvm59.example.com | success | rc=0 | (stdout)  Id    Name                           State\n----------------------------------------------------\n
+`)
+
+var ansibleJSONCallbackOutput = []byte(`{
+    "custom_stats": {},
+    "global_custom_stats": {},
+    "plays": [
+        {
+            "play": {"name": "Ansible Ad-Hoc"},
+            "tasks": [
+                {
+                    "hosts": {
+                        "kvm09.example.com": {
+                            "changed": true,
+                            "rc": 0,
+                            "stderr": "",
+                            "stdout": " Id    Name                           State\n----------------------------------------------------\n 4     tam                            running\n -     olh                            shut off\n"
+                        },
+                        "kvm21.example.com": {
+                            "changed": false,
+                            "msg": "Failed to connect to the host via ssh: ssh: Could not resolve hostname kvm21.example.com: Name or service not known",
+                            "unreachable": true
+                        },
+                        "kvm30.example.com": {
+                            "changed": false,
+                            "msg": "Failed to connect to the host via ssh: ssh: connect to host kvm30.example.com port 22: Connection timed out",
+                            "unreachable": true
+                        },
+                        "kvm43.example.com": {
+                            "changed": true,
+                            "rc": 0,
+                            "stdout": " Id    Name                           State\n----------------------------------------------------\n 99    compute-64                     paused\n"
+                        },
+                        "kvm59.example.com": {
+                            "changed": true,
+                            "rc": 0,
+                            "stdout": " Id    Name                           State\n----------------------------------------------------\n"
+                        }
+                    },
+                    "task": {"name": "command"}
+                }
+            ]
+        }
+    ],
+    "stats": {}
+}`)
+
+func TestParseAnsibleOutputFormats(t *testing.T) {
+	expected, err := ParseAnsibleOutput(ansibleOutput)
+	if err != nil {
+		t.Fatalf("ParseAnsibleOutput() returned an error on text output: %v", err)
+	}
+	tests := []struct {
+		name   string
+		output []byte
+	}{
+		{"oneline", ansibleOnelineOutput},
+		{"json", ansibleJSONCallbackOutput},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vmap, err := ParseAnsibleOutput(test.output)
+			if err != nil {
+				t.Fatalf("ParseAnsibleOutput() returned an error unexpectedly: %v", err)
+			}
+			// The error messages differ between the formats
+			if !reflect.DeepEqual(withoutHostErrors(vmap), withoutHostErrors(expected)) {
+				t.Fatalf("ParseAnsibleOutput() failed.\nGot:\n%#v\nExpected:\n%#v", vmap, expected)
+			}
+		})
+	}
+}
+
+// withoutHostErrors returns a copy of the map without the hosts' error messages
+func withoutHostErrors(v *Vmap) *Vmap {
+	c := &Vmap{Hosts: make(map[string]VHost), Guests: v.Guests, Aliases: v.Aliases}
+	for name, h := range v.Hosts {
+		h.Error = ""
+		c.Hosts[name] = h
+	}
+	return c
+}
+
+func TestParseStatusLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		status HostStatus
+		msg    string
+	}{
+		{"kvm09.example.com | success | rc=0 >>", HostUp, ""},
+		{"kvm09.example.com | CHANGED | rc=0 >>", HostUp, ""},
+		{"kvm09.example.com | SUCCESS => {", HostUp, ""},
+		{"kvm10.example.com | FAILED | rc=1 >>", HostCommandFailed, "non-zero return code (rc=1)"},
+		{"kvm10.example.com | FAILED | rc=127 | (stdout)  | (stderr) virsh: command not found", HostCommandFailed, "non-zero return code (rc=127)"},
+		{"kvm21.example.com | FAILED => FAILED: [Errno -2] Name or service not known", HostUnreachableDNS, "FAILED: [Errno -2] Name or service not known"},
+		{"kvm30.example.com | FAILED => FAILED: timed out", HostTimeout, "FAILED: timed out"},
+		{"kvm31.example.com | UNREACHABLE! => Failed to connect to the host via ssh: root@kvm31.example.com: Permission denied (publickey,password).", HostAuthFailed, "Failed to connect to the host via ssh: root@kvm31.example.com: Permission denied (publickey,password)."},
+		{"kvm30.example.com | UNREACHABLE!: Failed to connect to the host via ssh: ssh: connect to host kvm30.example.com port 22: Connection timed out", HostTimeout, "Failed to connect to the host via ssh: ssh: connect to host kvm30.example.com port 22: Connection timed out"},
+		{"kvm12.example.com | FAILED! => ", HostUnknown, ""},
+		{"kvm32.example.com | UNREACHABLE! => Failed to connect to the host via ssh: ssh: connect to host kvm32.example.com port 22: Connection refused", HostUnknown, "Failed to connect to the host via ssh: ssh: connect to host kvm32.example.com port 22: Connection refused"},
+	}
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			_, status, msg := parseStatusLine(test.line)
+			if status != test.status || msg != test.msg {
+				t.Fatalf("parseStatusLine() failed.\nGot:\n%q %q\nExpected:\n%q %q", status, msg, test.status, test.msg)
+			}
+		})
+	}
+}
+
+func TestParseAnsibleOutputJSONFailed(t *testing.T) {
+	output := []byte(`{"plays": [{"tasks": [{"hosts": {
+		"kvm10.example.com": {"changed": true, "failed": true, "rc": 1, "msg": "non-zero return code", "stdout": "", "stderr": "error: failed to connect to the hypervisor"},
+		"kvm31.example.com": {"changed": false, "unreachable": true, "msg": "Failed to connect to the host via ssh: root@kvm31.example.com: Permission denied (publickey,password)."}
+	}}]}]}`)
+	vmap, err := ParseAnsibleOutput(output)
+	if err != nil {
+		t.Fatalf("ParseAnsibleOutput() returned an error unexpectedly: %v", err)
+	}
+	expected := map[string]VHost{
+		"kvm10.example.com": VHost{State: "up", Status: HostCommandFailed, Error: "error: failed to connect to the hypervisor"},
+		"kvm31.example.com": VHost{State: "down", Status: HostAuthFailed, Error: "Failed to connect to the host via ssh: root@kvm31.example.com: Permission denied (publickey,password)."},
+	}
+	if !reflect.DeepEqual(vmap.Hosts, expected) {
+		t.Fatalf("ParseAnsibleOutput() failed.\nGot:\n%#v\nExpected:\n%#v", vmap.Hosts, expected)
+	}
+}
+
+// The fixtures in testdata/ansible are the output of "virsh list --all" on
+// the same hosts from the Ansible versions and callbacks in their names
+func TestParseAnsibleOutputFixtures(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "ansible", "*"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("No Ansible output fixtures found: %v", err)
+	}
+	statuses := map[string]HostStatus{
+		"kvm09.example.com": "",
+		"kvm43.example.com": "",
+		"kvm59.example.com": "",
+		"kvm21.example.com": HostUnreachableDNS,
+		"kvm30.example.com": HostTimeout,
+		"kvm31.example.com": HostAuthFailed,
+		"kvm10.example.com": HostCommandFailed,
+		"kvm12.example.com": HostCommandFailed,
+	}
+	// Ansible 1 didn't report the return code of a module which didn't run
+	overrides := map[string]map[string]HostStatus{
+		"ansible-1.9-default.txt": {"kvm12.example.com": HostUnknown},
+	}
+	guests := map[string]VGuest{
+		"tam":        VGuest{State: "running", Host: "kvm09.example.com"},
+		"olh":        VGuest{State: "shut off", Host: "kvm09.example.com"},
+		"compute-64": VGuest{State: "paused", Host: "kvm43.example.com"},
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			output, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vmap, diags, err := ParseAnsibleOutputWithDiagnostics(output)
+			if err != nil {
+				t.Fatalf("ParseAnsibleOutputWithDiagnostics() returned an error unexpectedly: %v", err)
+			}
+			for _, d := range diags {
+				if d.Severity == SeverityError {
+					t.Errorf("ParseAnsibleOutputWithDiagnostics() reported an error: %v", d)
+				}
+			}
+			if !reflect.DeepEqual(vmap.Guests, guests) {
+				t.Errorf("ParseAnsibleOutputWithDiagnostics() returned the wrong guests.\nGot:\n%#v\nExpected:\n%#v", vmap.Guests, guests)
+			}
+			if len(vmap.Hosts) != len(statuses) {
+				t.Errorf("ParseAnsibleOutputWithDiagnostics() returned %d hosts, expected %d", len(vmap.Hosts), len(statuses))
+			}
+			for name, status := range statuses {
+				if s, ok := overrides[filepath.Base(file)][name]; ok {
+					status = s
+				}
+				h, ok := vmap.Hosts[name]
+				if !ok {
+					t.Errorf("Host %s is missing", name)
+					continue
+				}
+				if h.Status != status {
+					t.Errorf("Host %s has status %q, expected %q", name, h.Status, status)
+				}
+				// The error message is extracted from any JSON result
+				if status != "" && (h.Error == "" || strings.HasPrefix(h.Error, "{")) {
+					t.Errorf("Host %s has the wrong error message %q", name, h.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAnsibleOutputBadJSON(t *testing.T) {
+	_, err := ParseAnsibleOutput([]byte(`{"plays": [{"tasks": [`))
+	if err == nil {
+		t.Fatal("ParseAnsibleOutput() accepted truncated JSON output")
+	}
+}
+
+var ansibleOutputProblems = []byte(`[WARNING]: Invalid characters were found in group names
+kvm21.example.com | FAILED => FAILED: [Errno -2] Name or service not known
+kvm09.example.com | success | rc=0 >>
+ Id    Name                           State
+----------------------------------------------------
+ 4     tam                            running
+ -     olh                            sleeping
+kvm10.example.com | FAILED | rc=1 >>
+error: failed to connect to the hypervisor
+kvm30.example.com | FAILED => FAILED: timed out
+kvm11.example.com | success | rc=0 | (stdout)  Id    Name                           State\n----------------------------------------------------\n 5     tam                            running\n
+`)
+
+func TestParseAnsibleOutputWithDiagnostics(t *testing.T) {
+	vmap, diags, err := ParseAnsibleOutputWithDiagnostics(ansibleOutputProblems)
+	if err != nil {
+		t.Fatalf("ParseAnsibleOutputWithDiagnostics() returned an error unexpectedly: %v", err)
+	}
+	failed := VHost{State: "up", Status: HostCommandFailed, Error: "error: failed to connect to the hypervisor"}
+	if !reflect.DeepEqual(vmap.Hosts["kvm10.example.com"], failed) {
+		t.Fatalf("ParseAnsibleOutputWithDiagnostics() returned the wrong failed host.\nGot:\n%#v\nExpected:\n%#v", vmap.Hosts["kvm10.example.com"], failed)
+	}
+	expected := []Diagnostic{
+		{Line: 1, Text: "[WARNING]: Invalid characters were found in group names", Reason: "message from Ansible", Severity: SeverityWarning},
+		{Line: 2, Text: "kvm21.example.com | FAILED => FAILED: [Errno -2] Name or service not known", Reason: "host kvm21.example.com could not be resolved, its guests are missing", Severity: SeverityWarning},
+		{Line: 7, Text: " -     olh                            sleeping", Reason: `unknown state "sleeping" for guest olh`, Severity: SeverityWarning},
+		{Line: 8, Text: "kvm10.example.com | FAILED | rc=1 >>", Reason: "host kvm10.example.com failed to run virsh, its guests are missing", Severity: SeverityWarning},
+		{Line: 10, Text: "kvm30.example.com | FAILED => FAILED: timed out", Reason: "host kvm30.example.com timed out, its guests are missing", Severity: SeverityWarning},
+		{Line: 11, Text: " 5     tam                            running", Reason: "guest tam is running on more than one host: kvm09.example.com, kvm11.example.com", Severity: SeverityError},
+	}
+	if !reflect.DeepEqual(diags, expected) {
+		t.Fatalf("ParseAnsibleOutputWithDiagnostics() returned the wrong diagnostics.\nGot:\n%#v\nExpected:\n%#v", diags, expected)
+	}
+}
+
+func TestParseAnsibleReader(t *testing.T) {
+	for _, output := range [][]byte{ansibleOutput, ansibleOnelineOutput, ansibleJSONCallbackOutput, ansibleOutputProblems} {
+		expected, expectedDiags, err := ParseAnsibleOutputWithDiagnostics(output)
+		if err != nil {
+			t.Fatalf("ParseAnsibleOutputWithDiagnostics() returned an error unexpectedly: %v", err)
+		}
+		// A reader returning a byte at a time splits every line and token
+		vmap, diags, err := ParseAnsibleReader(&oneByteReader{bytes.NewReader(output)})
+		if err != nil {
+			t.Fatalf("ParseAnsibleReader() returned an error unexpectedly: %v", err)
+		}
+		if !reflect.DeepEqual(vmap, expected) || !reflect.DeepEqual(diags, expectedDiags) {
+			t.Fatalf("ParseAnsibleReader() failed.\nGot:\n%#v\n%#v\nExpected:\n%#v\n%#v", vmap, diags, expected, expectedDiags)
+		}
+	}
+}
+
+func TestParseAnsibleReaderSynthetic(t *testing.T) {
+	vmap, diags, err := ParseAnsibleReader(&syntheticOutput{hosts: 100, guests: 40})
+	if err != nil {
+		t.Fatalf("ParseAnsibleReader() returned an error unexpectedly: %v", err)
+	}
+	if len(vmap.Hosts) != 100 || len(vmap.Guests) != 4000 || len(diags) != 0 {
+		t.Fatalf("ParseAnsibleReader() failed, got %d hosts, %d guests and %d diagnostics", len(vmap.Hosts), len(vmap.Guests), len(diags))
+	}
+}
+
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (o *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
+
+// The benchmark input defaults to about 2MB, 40k guests.  Use e.g.
+// -benchhosts=100000 for an input of a few hundred MB.
+var benchHosts = flag.Int("benchhosts", 1000, "number of hosts, with 40 guests each, in the benchmark input")
+
+// syntheticOutput generates Ansible text output as it is read,
+// so that large inputs needn't be held in memory
+type syntheticOutput struct {
+	hosts, guests int
+	host          int
+	buf           bytes.Buffer
+}
+
+func (s *syntheticOutput) Read(p []byte) (int, error) {
+	for s.buf.Len() < len(p) && s.host < s.hosts {
+		fmt.Fprintf(&s.buf, "kvm%06d.example.com | CHANGED | rc=0 >>\n", s.host)
+		s.buf.WriteString(" Id    Name                           State\n")
+		s.buf.WriteString("----------------------------------------------------\n")
+		for g := 0; g < s.guests; g++ {
+			state := "running"
+			if g%4 == 0 {
+				state = "shut off"
+			}
+			fmt.Fprintf(&s.buf, " %-5d %-30s %s\n", g+1, fmt.Sprintf("guest-%06d-%03d", s.host, g), state)
+		}
+		s.buf.WriteString("\n")
+		s.host++
+	}
+	if s.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return s.buf.Read(p)
+}
+
+func BenchmarkParseAnsibleOutput(b *testing.B) {
+	output, err := ioutil.ReadAll(&syntheticOutput{hosts: *benchHosts, guests: 40})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(output)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseAnsibleOutput(output); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkParseAnsibleReader streams the input from the generator, so its
+// memory use is that of the map alone.  The time includes generating the input.
+func BenchmarkParseAnsibleReader(b *testing.B) {
+	size, err := io.Copy(ioutil.Discard, &syntheticOutput{hosts: *benchHosts, guests: 40})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ParseAnsibleReader(&syntheticOutput{hosts: *benchHosts, guests: 40}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseAnsibleReaderJSON(b *testing.B) {
+	text, err := ioutil.ReadAll(&syntheticOutput{hosts: *benchHosts, guests: 40})
+	if err != nil {
+		b.Fatal(err)
+	}
+	// Convert the text output to the json callback format
+	doc := ansibleJSONOutput{Plays: []ansibleJSONPlay{{Tasks: []ansibleJSONTask{{Hosts: map[string]ansibleJSONHost{}}}}}}
+	for _, block := range strings.Split(string(text), "\n\n") {
+		if i := strings.Index(block, "\n"); i > 0 {
+			doc.Plays[0].Tasks[0].Hosts[strings.Fields(block)[0]] = ansibleJSONHost{Stdout: block[i+1:]}
+		}
+	}
+	output, err := json.Marshal(doc)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(output)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ParseAnsibleReader(bytes.NewReader(output)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
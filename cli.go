@@ -4,10 +4,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/urfave/cli"
 )
@@ -22,11 +29,61 @@ var HTTPGetter = func(url string) (*http.Response, error) {
 	return http.Get(url)
 }
 
+// Reload asks the server to reload its map, authenticated with
+// the admin token, and returns the outcome of the reload
+func Reload(httpServer string, token string) (*ReloadStatus, error) {
+	req, err := http.NewRequest("POST", serverURL(httpServer)+AdminReloadPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var data struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &data) != nil || data.Error == "" {
+			data.Error = resp.Status
+		}
+		return nil, errors.New(data.Error)
+	}
+	status := &ReloadStatus{}
+	if err := json.Unmarshal(body, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
 // Query is the cli client function.  It queries the given server for the
 // given host, unmarshalls the JSON, and returns a result Vmap pointer.
 func Query(httpServer string, query string) (*Vmap, error) {
+	return getVmap("http://" + httpServer + APIPrefix + "vmap/" + query)
+}
+
+// QueryAt is Query for the map as it was at a time
+func QueryAt(httpServer string, query string, at time.Time) (*Vmap, error) {
+	return Query(httpServer, query+"?at="+url.QueryEscape(at.Format(time.RFC3339)))
+}
+
+// Search queries the given server for all of the hosts and
+// guests whose names match query in the given mode
+func Search(httpServer string, query string, mode SearchMode) (*Vmap, error) {
+	params := url.Values{"q": {query}, "mode": {string(mode)}}
+	return getVmap("http://" + httpServer + SearchPath + "?" + params.Encode())
+}
+
+// getVmap gets a Vmap from the server at the URL
+func getVmap(u string) (*Vmap, error) {
 	vmap := &Vmap{}
-	rawResponse, err := HTTPGetter("http://" + httpServer + APIPrefix + "vmap/" + query)
+	rawResponse, err := HTTPGetter(u)
 	if err != nil {
 		fmt.Printf("Get() error, %v\n", err)
 		return nil, err
@@ -58,14 +115,239 @@ func Query(httpServer string, query string) (*Vmap, error) {
 	return vmap, nil
 }
 
-// Display takes a result Vmap from Query() and displays it to the user.
+// History queries the given server for the changes recorded to a guest
+func History(httpServer string, guest string) ([]GuestEvent, error) {
+	var response struct {
+		Events []GuestEvent `json:"events"`
+	}
+	if err := getJSON("http://"+httpServer+GuestsPrefix+url.PathEscape(guest)+"/history", &response); err != nil {
+		return nil, err
+	}
+	return response.Events, nil
+}
+
+// ListGuests queries the given server for a page of the guests
+// which pass the filters in params
+func ListGuests(httpServer string, params url.Values) (*GuestList, error) {
+	list := &GuestList{}
+	if err := getJSON("http://"+httpServer+GuestsPath+"?"+params.Encode(), list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ListHosts queries the given server for a page of the hosts
+// which pass the filters in params
+func ListHosts(httpServer string, params url.Values) (*HostList, error) {
+	list := &HostList{}
+	if err := getJSON("http://"+httpServer+HostsPath+"?"+params.Encode(), list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// getJSON gets the JSON response at the URL into v,
+// returning the error in the response if there is one
+func getJSON(u string, v interface{}) error {
+	rawResponse, err := HTTPGetter(u)
+	if err != nil {
+		return err
+	}
+	defer rawResponse.Body.Close()
+	body, err := ioutil.ReadAll(rawResponse.Body)
+	if err != nil {
+		return err
+	}
+	var response struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return err
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// DisplayGuests prints a list of guests as a table
+func DisplayGuests(w io.Writer, l *GuestList) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tHOST\tLAST SEEN")
+	for _, g := range l.Guests {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", g.Name, g.State, g.Host, lastSeen(g.LastSeen, g.Stale))
+	}
+	tw.Flush()
+	displayPage(w, l.Offset, len(l.Guests), l.Total, "guests")
+}
+
+// DisplayHosts prints a list of hosts as a table
+func DisplayHosts(w io.Writer, l *HostList) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tSTATUS\tGUESTS\tLAST SEEN")
+	for _, h := range l.Hosts {
+		status := h.Status
+		if status == "" {
+			status = HostUp
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", h.Name, h.State, status, len(h.Guests), lastSeen(h.LastSeen, h.Stale))
+	}
+	tw.Flush()
+	displayPage(w, l.Offset, len(l.Hosts), l.Total, "hosts")
+}
+
+// lastSeen formats the time a node was last seen for a table
+func lastSeen(t *time.Time, stale bool) string {
+	if t == nil {
+		return "-"
+	}
+	s := t.Local().Format("2006-01-02 15:04:05")
+	if stale {
+		s += " (stale)"
+	}
+	return s
+}
+
+// displayPage prints which entries of a list were shown, if not all were
+func displayPage(w io.Writer, offset, n, total int, what string) {
+	if n == total {
+		return
+	}
+	if n == 0 {
+		fmt.Fprintf(w, "No %s shown of %d\n", what, total)
+		return
+	}
+	fmt.Fprintf(w, "Showing %d-%d of %d %s\n", offset+1, offset+n, total, what)
+}
+
+// listParams returns the query parameters of the list command's
+// flags, those which may be repeated and those which may not
+func listParams(c *cli.Context, repeated []string, single ...string) url.Values {
+	params := url.Values{}
+	for _, name := range repeated {
+		for _, value := range c.StringSlice(name) {
+			params.Add(name, value)
+		}
+	}
+	for _, name := range append(single, "sort") {
+		if s := c.String(name); s != "" {
+			params.Set(name, s)
+		}
+	}
+	for _, name := range []string{"offset", "limit"} {
+		if n := c.Int(name); n > 0 {
+			params.Set(name, strconv.Itoa(n))
+		}
+	}
+	return params
+}
+
+// Display takes a result Vmap from Query() and displays it to the user,
+// with a warning for any guest defined on more than one host, whose host
+// is unreachable, or which the server marked as stale.
 func Display(vmap *Vmap) {
-	for n := range vmap.Hosts {
+	if vmap.Restored != nil {
+		fmt.Printf("Warning: the map was restored from a snapshot loaded at %s, its sources haven't loaded since\n", vmap.Restored.Loaded.Format(time.RFC3339))
+	}
+	for _, n := range vmap.hostNames() {
+		h := vmap.Hosts[n]
 		fmt.Println(vmap.Info(n))
+		if labels := LabelsLine(h.Labels); labels != "" {
+			fmt.Println(labels)
+		}
+		if warning := StaleWarning(n, h.Stale, h.LastSeen); warning != "" {
+			fmt.Println(warning)
+		}
 	}
-	for n := range vmap.Guests {
+	for _, n := range vmap.guestNames() {
+		g := vmap.Guests[n]
 		fmt.Println(vmap.Info(n))
+		if labels := LabelsLine(g.Labels); labels != "" {
+			fmt.Println(labels)
+		}
+		if warning := PlacementWarning(n, g); warning != "" {
+			fmt.Println(warning)
+		}
+		if warning := UnreachableWarning(n, g); warning != "" {
+			fmt.Println(warning)
+		} else if warning := StaleWarning(n, g.Stale, g.LastSeen); warning != "" {
+			fmt.Println(warning)
+		}
+	}
+}
+
+// PlacementWarning returns a warning if the guest is defined on
+// more than one host, or an empty string if it isn't.
+func PlacementWarning(name string, g VGuest) string {
+	if g.SplitBrain {
+		return fmt.Sprintf("WARNING: %s is running on more than one host: %s", name, strings.Join(g.runningHosts(), ", "))
+	}
+	var others []string
+	for _, p := range g.Placements {
+		if p.Host != g.Host {
+			others = append(others, fmt.Sprintf("%s (%s)", p.Host, p.State))
+		}
+	}
+	if len(others) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Warning: %s is also defined on: %s", name, strings.Join(others, ", "))
+}
+
+// ParseAliases parses alias flags of the form alias=name into a map
+func ParseAliases(flags []string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	for _, f := range flags {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Bad alias %q, expected alias=name", f)
+		}
+		aliases[parts[0]] = parts[1]
+	}
+	return aliases, nil
+}
+
+// Validate loads the given source and prints its Diagnostics and a summary
+// to the user.  It returns false if the source couldn't be loaded or
+// has any errors.
+func Validate(config string) bool {
+	src, err := NewSource(config)
+	if err != nil {
+		fmt.Printf("Source error: %v\n", err)
+		return false
+	}
+	vmap, diags, err := LoadSource(src)
+	if err != nil {
+		fmt.Printf("Load error: %v\n", err)
+		return false
 	}
+	errCount := 0
+	for _, d := range diags {
+		fmt.Println(d)
+		if d.Severity == SeverityError {
+			errCount++
+		}
+	}
+	fmt.Printf("%s: %d hosts, %d guests, %d errors, %d warnings\n",
+		src.Name(), len(vmap.Hosts), len(vmap.Guests), errCount, len(diags)-errCount)
+	return errCount == 0
+}
+
+// listFlags are the flags of both of the list commands
+var listFlags = []cli.Flag{
+	cli.IntFlag{
+		Name:  "limit",
+		Usage: "largest number of entries to list, 0 for all",
+	},
+	cli.IntFlag{
+		Name:  "offset",
+		Usage: "number of entries to skip",
+	},
+	cli.StringFlag{
+		Name:  "server, s",
+		Usage: "address of server to query",
+		Value: "localhost:7474",
+	},
 }
 
 // CLIApp creates the cli application with commands and config defaults
@@ -100,11 +382,102 @@ func CLIApp() *cli.App {
 				Value: RefreshInterval,
 				Usage: "map refresh interval in minutes",
 			},
+			cli.BoolTFlag{
+				Name:  "watch",
+				Usage: "reload as soon as a file or tree source changes, polling if it can't be watched (default: true, --watch=false to disable)",
+			},
+			cli.IntFlag{
+				Name:  "watchDebounce",
+				Value: WatchDebounce,
+				Usage: "time in seconds a watched source must be unchanged before it is reloaded",
+			},
+			cli.Float64Flag{
+				Name:  "reloadMaxShrink",
+				Value: ReloadMaxShrink,
+				Usage: "largest percentage of the guests a reload may drop, 0 for any",
+			},
+			cli.IntFlag{
+				Name:  "reloadMinHosts",
+				Usage: "fewest hosts a reload may have",
+			},
+			cli.StringSliceFlag{
+				Name:  "reloadMarker",
+				Usage: "text every file source must contain to be complete, may be repeated",
+			},
+			cli.IntFlag{
+				Name:  "reloadMaxAge",
+				Usage: "age in minutes after which a file or tree source is stale, 0 for any",
+			},
+			cli.StringFlag{
+				Name:  "stateDir",
+				Value: StateDir,
+				Usage: "directory to save a snapshot of the map in, restored at startup, \"\" to disable",
+			},
+			cli.IntFlag{
+				Name:  "migrationLogSize",
+				Value: MigrationLogSize,
+				Usage: "number of the latest migrations of guests to keep",
+			},
+			cli.IntFlag{
+				Name:  "historyRetention",
+				Value: HistoryRetention,
+				Usage: "time in days the history of the guests is kept for, 0 for ever",
+			},
+			cli.StringFlag{
+				Name:  "metadata",
+				Usage: "YAML file of the labels and annotations of hosts and guests, read at every reload",
+			},
+			cli.IntFlag{
+				Name:  "staleAfter",
+				Value: StaleAfter,
+				Usage: "time in minutes after which a node which hasn't been seen is stale, 0 for never",
+			},
 			cli.StringFlag{
 				Name:  "ansibleOutputFile, v",
 				Value: AnsibleOutputFile,
 				Usage: "path to Ansible output file to read",
 			},
+			cli.StringSliceFlag{
+				Name:  "source, s",
+				Usage: "map source as kind:spec (" + strings.Join(SourceKinds(), ", ") + "), may be repeated (default: ansibleOutputFile)",
+			},
+			cli.StringSliceFlag{
+				Name:  "alias",
+				Usage: "alternative name for a node as alias=name, may be repeated",
+			},
+			cli.StringSliceFlag{
+				Name:   "reportToken",
+				Usage:  "token hosts present to push reports, may be repeated (default: reports disabled)",
+				EnvVar: "VIRTMAPPER_REPORT_TOKEN",
+			},
+			cli.StringSliceFlag{
+				Name:   "adminToken",
+				Usage:  "token admins present to request reloads, may be repeated (default: admin requests disabled)",
+				EnvVar: "VIRTMAPPER_ADMIN_TOKEN",
+			},
+			cli.StringSliceFlag{
+				Name:  "collectHost",
+				Usage: "host to run the collect command on, without Ansible, may be repeated",
+			},
+			cli.StringFlag{
+				Name:  "collectHostsFile",
+				Usage: "file listing the hosts to run the collect command on, one per line",
+			},
+			cli.StringFlag{
+				Name:  "collectCommand",
+				Value: CollectCommand,
+				Usage: "command listing the guests of {host}, run by the shell",
+			},
+			cli.IntFlag{
+				Name:  "collectTimeout",
+				Value: CollectTimeout,
+				Usage: "time limit of the collect command on each host in seconds",
+			},
+			cli.IntFlag{
+				Name:  "collectConcurrency",
+				Value: CollectConcurrency,
+				Usage: "number of hosts to run the collect command on at once",
+			},
 		},
 		Action: func(c *cli.Context) {
 			f, err := os.OpenFile(c.String("logfile"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
@@ -114,7 +487,52 @@ func CLIApp() *cli.App {
 			}
 			defer f.Close()
 			log.SetOutput(f)
-			v := newServer()
+			collect := len(c.StringSlice("collectHost")) > 0 || c.String("collectHostsFile") != ""
+			configs := c.StringSlice("source")
+			if len(configs) == 0 && !collect {
+				configs = []string{c.String("ansibleOutputFile")}
+			}
+			sources, err := NewSources(configs)
+			if err != nil {
+				fmt.Printf("Source error: %v\n", err)
+				os.Exit(1)
+			}
+			if collect {
+				src, err := newCollectSource(c.StringSlice("collectHost"), c.String("collectHostsFile"),
+					c.String("collectCommand"), time.Duration(c.Int("collectTimeout"))*time.Second, c.Int("collectConcurrency"))
+				if err != nil {
+					fmt.Printf("Source error: %v\n", err)
+					os.Exit(1)
+				}
+				sources = append(sources, src)
+			}
+			aliases, err := ParseAliases(c.StringSlice("alias"))
+			if err != nil {
+				fmt.Printf("Alias error: %v\n", err)
+				os.Exit(1)
+			}
+			v := newServer(sources, aliases)
+			v.reportTokens = c.StringSlice("reportToken")
+			v.adminTokens = c.StringSlice("adminToken")
+			v.stateDir = c.String("stateDir")
+			v.migrations = newMigrationLog(c.Int("migrationLogSize"))
+			v.staleAfter = time.Duration(c.Int("staleAfter")) * time.Minute
+			v.metadata.path = c.String("metadata")
+			historyPath := ""
+			if v.stateDir != "" {
+				historyPath = filepath.Join(v.stateDir, historyFile)
+			}
+			retention := time.Duration(c.Int("historyRetention")) * 24 * time.Hour
+			if v.history, err = openHistory(historyPath, retention); err != nil {
+				fmt.Printf("History error: %v\n", err)
+				os.Exit(1)
+			}
+			v.guard = reloadGuard{
+				maxShrink: c.Float64("reloadMaxShrink"),
+				minHosts:  c.Int("reloadMinHosts"),
+				markers:   c.StringSlice("reloadMarker"),
+				maxAge:    time.Duration(c.Int("reloadMaxAge")) * time.Minute,
+			}
 			v.Serve(c)
 		},
 	}, {
@@ -127,15 +545,278 @@ func CLIApp() *cli.App {
 				Usage: "address of server to query",
 				Value: "localhost:7474",
 			},
+			cli.StringFlag{
+				Name:  "at",
+				Usage: "time to query the map as it was at, e.g. 2026-09-01T12:00 in local time",
+			},
 		},
 		Action: func(c *cli.Context) {
-			result, err := Query(c.String("server"), c.Args().Get(0))
+			var result *Vmap
+			var err error
+			if c.String("at") != "" {
+				var at time.Time
+				if at, err = parseTime(c.String("at")); err == nil {
+					result, err = QueryAt(c.String("server"), c.Args().Get(0), at)
+				}
+			} else {
+				result, err = Query(c.String("server"), c.Args().Get(0))
+			}
 			if err != nil {
 				fmt.Printf("Query error: %v\n", err)
 				os.Exit(1)
 			}
 			Display(result)
 		},
+	}, {
+		Name:      "search",
+		Usage:     "search a server for the hosts and guests whose names match a pattern",
+		ArgsUsage: "<pattern>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "server, s",
+				Usage: "address of server to query",
+				Value: "localhost:7474",
+			},
+			cli.StringFlag{
+				Name:  "mode, m",
+				Usage: "how the pattern matches names: glob, prefix or regex",
+				Value: string(SearchGlob),
+			},
+		},
+		Action: func(c *cli.Context) {
+			if c.NArg() != 1 {
+				fmt.Println("search requires one pattern")
+				os.Exit(1)
+			}
+			result, err := Search(c.String("server"), c.Args().Get(0), SearchMode(c.String("mode")))
+			if err != nil {
+				fmt.Printf("Search error: %v\n", err)
+				os.Exit(1)
+			}
+			if result.Length() == 0 {
+				fmt.Printf("Nothing matches %s\n", c.Args().Get(0))
+				os.Exit(1)
+			}
+			Display(result)
+		},
+	}, {
+		Name:  "list",
+		Usage: "list the guests or hosts of a server which pass filters",
+		Subcommands: []cli.Command{{
+			Name:  "guests",
+			Usage: "list the guests which pass filters",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "name",
+					Usage: "glob the name of the guest must match",
+				},
+				cli.StringSliceFlag{
+					Name:  "state",
+					Usage: "state the guest must be in, e.g. running, may be repeated to allow any of them",
+				},
+				cli.StringFlag{
+					Name:  "host",
+					Usage: "glob the name of the guest's host must match, e.g. kvm4*",
+				},
+				cli.StringFlag{
+					Name:  "hoststate",
+					Usage: "state the guest's host must be in, up or down",
+				},
+				cli.StringFlag{
+					Name:  "stale",
+					Usage: "true for only the stale guests, false for only the fresh ones",
+				},
+				cli.StringSliceFlag{
+					Name:  "label",
+					Usage: "label the guest must have as key=value, or key for any value, may be repeated",
+				},
+				cli.StringFlag{
+					Name:  "sort",
+					Usage: "field to sort by: " + strings.Join(guestSortKeys, ", ") + ", with a leading - to reverse it",
+				},
+			}, listFlags...),
+			Action: func(c *cli.Context) {
+				list, err := ListGuests(c.String("server"), listParams(c, []string{"state", "label"}, "name", "host", "hoststate", "stale"))
+				if err != nil {
+					fmt.Printf("List error: %v\n", err)
+					os.Exit(1)
+				}
+				DisplayGuests(os.Stdout, list)
+			},
+		}, {
+			Name:  "hosts",
+			Usage: "list the hosts which pass filters",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "name",
+					Usage: "glob the name of the host must match",
+				},
+				cli.StringFlag{
+					Name:  "state",
+					Usage: "state the host must be in, up or down",
+				},
+				cli.StringSliceFlag{
+					Name:  "status",
+					Usage: "status the host must have, e.g. timeout, may be repeated to allow any of them",
+				},
+				cli.StringFlag{
+					Name:  "stale",
+					Usage: "true for only the stale hosts, false for only the fresh ones",
+				},
+				cli.StringSliceFlag{
+					Name:  "label",
+					Usage: "label the host must have as key=value, or key for any value, may be repeated",
+				},
+				cli.StringFlag{
+					Name:  "sort",
+					Usage: "field to sort by: " + strings.Join(hostSortKeys, ", ") + ", with a leading - to reverse it",
+				},
+			}, listFlags...),
+			Action: func(c *cli.Context) {
+				list, err := ListHosts(c.String("server"), listParams(c, []string{"status", "label"}, "name", "state", "stale"))
+				if err != nil {
+					fmt.Printf("List error: %v\n", err)
+					os.Exit(1)
+				}
+				DisplayHosts(os.Stdout, list)
+			},
+		}},
+	}, {
+		Name:      "history",
+		Usage:     "show the changes a server has recorded to a guest",
+		ArgsUsage: "<guest>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "server, s",
+				Usage: "address of server to query",
+				Value: "localhost:7474",
+			},
+		},
+		Action: func(c *cli.Context) {
+			if c.NArg() != 1 {
+				fmt.Println("history requires one guest")
+				os.Exit(1)
+			}
+			events, err := History(c.String("server"), c.Args().Get(0))
+			if err != nil {
+				fmt.Printf("Query error: %v\n", err)
+				os.Exit(1)
+			}
+			for _, e := range events {
+				fmt.Println(e)
+			}
+		},
+	}, {
+		Name:  "reload",
+		Usage: "make a server reload its map now, and show the outcome",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "server, s",
+				Usage: "address of server to reload, as host:port or a URL",
+				Value: "localhost:7474",
+			},
+			cli.StringFlag{
+				Name:   "adminToken",
+				Usage:  "token to present to the server",
+				EnvVar: "VIRTMAPPER_ADMIN_TOKEN",
+			},
+		},
+		Action: func(c *cli.Context) {
+			status, err := Reload(c.String("server"), c.String("adminToken"))
+			if err != nil {
+				fmt.Printf("Reload error: %v\n", err)
+				os.Exit(1)
+			}
+			if status.Error != "" {
+				fmt.Printf("Warning: %s\n", status.Error)
+			}
+			if !status.Accepted {
+				fmt.Printf("Reload rejected, the previous map was kept: %s\n", status.Rejected)
+				os.Exit(1)
+			}
+			fmt.Printf("Reloaded, %d hosts and %d guests in map\n", status.Hosts, status.Guests)
+		},
+	}, {
+		Name:  "agent",
+		Usage: "run on a hypervisor and push its guests to a server",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "server, s",
+				Usage: "address of server to report to, as host:port or a URL",
+				Value: "localhost:7474",
+			},
+			cli.StringFlag{
+				Name:  "host",
+				Usage: "name of this host in the map (default: the host name)",
+			},
+			cli.StringFlag{
+				Name:   "reportToken",
+				Usage:  "token to present to the server",
+				EnvVar: "VIRTMAPPER_REPORT_TOKEN",
+			},
+			cli.StringFlag{
+				Name:  "command",
+				Value: AgentCommand,
+				Usage: "command listing the guests, run by the shell",
+			},
+			cli.StringFlag{
+				Name:  "libvirt",
+				Usage: "libvirt URI to list the guests with instead of the command, e.g. qemu:///system",
+			},
+			cli.IntFlag{
+				Name:  "interval, i",
+				Value: AgentInterval,
+				Usage: "interval between listing the guests in seconds",
+			},
+			cli.IntFlag{
+				Name:  "heartbeat",
+				Value: AgentHeartbeat,
+				Usage: "interval in minutes after which the guests are pushed even if unchanged",
+			},
+			cli.IntFlag{
+				Name:  "retries",
+				Value: AgentRetries,
+				Usage: "number of times to retry a failed push, with exponential backoff",
+			},
+			cli.StringFlag{
+				Name:  "logfile, l",
+				Usage: "log file for agent activity (default: standard error)",
+			},
+		},
+		Action: func(c *cli.Context) {
+			if c.String("logfile") != "" {
+				f, err := os.OpenFile(c.String("logfile"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+				if err != nil {
+					fmt.Printf("Error opening file: %v\n", err)
+					os.Exit(1)
+				}
+				defer f.Close()
+				log.SetOutput(f)
+			}
+			a, err := newAgent(c.String("server"), c.String("host"), c.String("reportToken"),
+				c.String("command"), c.String("libvirt"), CollectTimeout*time.Second)
+			if err != nil {
+				fmt.Printf("Agent error: %v\n", err)
+				os.Exit(1)
+			}
+			a.heartbeat = time.Duration(c.Int("heartbeat")) * time.Minute
+			a.retries = c.Int("retries")
+			log.Printf("Starting agent for %s, reporting to %s", a.host, a.server)
+			a.run(time.Duration(c.Int("interval"))*time.Second, make(chan struct{}))
+		},
+	}, {
+		Name:      "validate",
+		Usage:     "check a map source, such as an Ansible output file, for problems",
+		ArgsUsage: "<source>",
+		Action: func(c *cli.Context) {
+			if c.NArg() != 1 {
+				fmt.Println("validate requires one source to check")
+				os.Exit(1)
+			}
+			if !Validate(c.Args().Get(0)) {
+				os.Exit(1)
+			}
+		},
 	}}
 	return app
 }
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -32,7 +34,7 @@ var tests = map[string]struct {
 		},
 		Vmap: Vmap{
 			Hosts: map[string]VHost{
-				"kvm09": VHost{"up", []string{"olh", "tam"}},
+				"kvm09": VHost{State: "up", Guests: []string{"olh", "tam"}},
 			},
 			Guests: map[string]VGuest(nil),
 		},
@@ -56,7 +58,7 @@ var tests = map[string]struct {
 		Vmap: Vmap{
 			Hosts: map[string]VHost(nil),
 			Guests: map[string]VGuest{
-				"tam": VGuest{"running", "kvm09"},
+				"tam": VGuest{State: "running", Host: "kvm09"},
 			},
 		},
 		Error: nil,
@@ -90,11 +92,11 @@ var tests = map[string]struct {
 		},
 		Vmap: Vmap{
 			Hosts: map[string]VHost{
-				"kvm09": VHost{"up", []string{"olh", "tam"}},
+				"kvm09": VHost{State: "up", Guests: []string{"olh", "tam"}},
 			},
 			Guests: map[string]VGuest{
-				"olh": VGuest{"running", "kvm09"},
-				"tam": VGuest{"paused", "kvm09"},
+				"olh": VGuest{State: "running", Host: "kvm09"},
+				"tam": VGuest{State: "paused", Host: "kvm09"},
 			},
 		},
 		Error: nil,
@@ -125,3 +127,68 @@ func TestQuery(t *testing.T) {
 		})
 	}
 }
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name   string
+		output []byte
+		valid  bool
+	}{
+		{"good.txt", ansibleOutput, true},
+		{"problems.txt", ansibleOutputProblems, false},
+		{"truncated.json", []byte(`{"plays": [{"tasks": [`), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := ioutil.WriteFile(path, tt.output, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if valid := Validate(path); valid != tt.valid {
+				t.Fatalf("Validate() returned %v, expected %v", valid, tt.valid)
+			}
+		})
+	}
+	if Validate(filepath.Join(dir, "missing.txt")) {
+		t.Fatal("Validate() accepted a missing file")
+	}
+}
+
+func TestPlacementWarning(t *testing.T) {
+	tests := []struct {
+		name    string
+		guest   VGuest
+		warning string
+	}{
+		{"tam", VGuest{State: "running", Host: "kvm09"}, ""},
+		{"olh", VGuest{
+			State: "running",
+			Host:  "kvm09",
+			Placements: []Placement{
+				{Host: "kvm09", State: "running"},
+				{Host: "kvm11", State: "shut off"},
+			},
+		}, "Warning: olh is also defined on: kvm11 (shut off)"},
+		{"web01", VGuest{
+			State: "running",
+			Host:  "kvm09",
+			Placements: []Placement{
+				{Host: "kvm09", State: "running"},
+				{Host: "kvm11", State: "running"},
+			},
+			SplitBrain: true,
+		}, "WARNING: web01 is running on more than one host: kvm09, kvm11"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if warning := PlacementWarning(tt.name, tt.guest); warning != tt.warning {
+				t.Fatalf("PlacementWarning() problem\nGot:\n%v\nExpected:\n%v", warning, tt.warning)
+			}
+		})
+	}
+}
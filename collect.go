@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// collectSource runs "virsh list --all" on each of the hosts itself, so
+// Ansible isn't needed.  The command is a template in which {host} is
+// replaced by the host name, and it is run by the shell.  The hosts are
+// either listed or read from hostsFile, one per line, at every Fetch.
+type collectSource struct {
+	hosts       []string
+	hostsFile   string
+	command     string
+	timeout     time.Duration
+	concurrency int
+}
+
+// newCollectSource creates a collect source for the hosts, or for the
+// hosts listed in hostsFile if it is given
+func newCollectSource(hosts []string, hostsFile string, command string, timeout time.Duration, concurrency int) (Source, error) {
+	if len(hosts) == 0 && hostsFile == "" {
+		return nil, fmt.Errorf("No hosts to collect from")
+	}
+	if !strings.Contains(command, "{host}") {
+		return nil, fmt.Errorf("Bad collect command, it has no {host}: %s", command)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &collectSource{
+		hosts:       hosts,
+		hostsFile:   hostsFile,
+		command:     command,
+		timeout:     timeout,
+		concurrency: concurrency,
+	}, nil
+}
+
+// newCollectSourceFile creates a collect source with the default
+// settings for the hosts listed in a file
+func newCollectSourceFile(spec string) (Source, error) {
+	return newCollectSource(nil, spec, CollectCommand, CollectTimeout*time.Second, CollectConcurrency)
+}
+
+func (c *collectSource) Name() string {
+	if c.hostsFile != "" {
+		return "collect:" + c.hostsFile
+	}
+	return "collect:" + strings.Join(c.hosts, ",")
+}
+
+// Fetch runs the command on all of the hosts, at most concurrency at a time,
+// and gathers the results into a document in the format of the json stdout
+// callback.  Hosts which fail are included with the reason for the failure.
+func (c *collectSource) Fetch() (io.ReadCloser, error) {
+	hosts := c.hosts
+	if c.hostsFile != "" {
+		var err error
+		if hosts, err = readHostsFile(c.hostsFile); err != nil {
+			return nil, err
+		}
+	}
+	results := make(map[string]ansibleJSONHost, len(hosts))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, c.concurrency)
+	for _, host := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(host string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			h := c.collect(host)
+			if h.Failed || h.Unreachable {
+				log.Printf("Collecting from %s failed: %s", host, h.Msg)
+			}
+			mu.Lock()
+			results[host] = h
+			mu.Unlock()
+		}(host)
+	}
+	wg.Wait()
+	return jsonHostsDocument(results)
+}
+
+func (c *collectSource) Parse(r io.Reader) (*Vmap, []Diagnostic, error) {
+	return ParseAnsibleReader(r)
+}
+
+// collect runs the command on one host
+func (c *collectSource) collect(host string) ansibleJSONHost {
+	return runCommand(strings.Replace(c.command, "{host}", shellQuote(host), -1), c.timeout)
+}
+
+// runCommand runs a command with the shell.  A command which doesn't finish
+// in time is killed and the host reported as unreachable, as is one which
+// exits with 255, which is how ssh reports connection errors.
+func runCommand(command string, timeout time.Duration) ansibleJSONHost {
+	// exec replaces the shell, so killing it kills the command
+	cmd := exec.Command("sh", "-c", "exec "+command)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Start(); err != nil {
+		return ansibleJSONHost{Failed: true, Rc: -1, Msg: err.Error()}
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return ansibleJSONHost{Unreachable: true, Msg: fmt.Sprintf("Command timed out after %v", timeout)}
+	}
+	h := ansibleJSONHost{Stdout: stdout.String(), Stderr: stderr.String()}
+	if err == nil {
+		return h
+	}
+	h.Failed, h.Rc, h.Msg = true, -1, err.Error()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		h.Rc, h.Msg = exitErr.ExitCode(), "non-zero return code"
+	}
+	if h.Rc == 255 {
+		h.Failed, h.Unreachable = false, true
+		h.Msg = strings.TrimSpace(h.Stderr)
+	}
+	return h
+}
+
+// readHostsFile reads a list of hosts, one per line.
+// Blank lines and comments starting with "#" are ignored.
+func readHostsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var hosts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		hosts = append(hosts, strings.Fields(line)...)
+	}
+	return hosts, scanner.Err()
+}
+
+// shellQuote quotes s as a single word for the shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
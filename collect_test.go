@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// collectStub stands in for ssh, printing what virsh would on each host
+var collectStub = `#!/bin/sh
+case "$1" in
+kvm09.example.com)
+	echo ' Id    Name                           State'
+	echo '----------------------------------------------------'
+	echo ' 4     tam                            running'
+	echo ' -     olh                            shut off'
+	;;
+kvm43.example.com)
+	echo ' Id    Name                           State'
+	echo '----------------------------------------------------'
+	echo ' 99    compute-64                     paused'
+	;;
+kvm10.example.com)
+	echo 'error: failed to connect to the hypervisor' >&2
+	exit 1
+	;;
+kvm21.example.com)
+	echo 'ssh: Could not resolve hostname kvm21.example.com: Name or service not known' >&2
+	exit 255
+	;;
+kvm30.example.com)
+	sleep 10
+	;;
+esac
+`
+
+func TestCollectSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stub := filepath.Join(dir, "stub.sh")
+	if err := ioutil.WriteFile(stub, []byte(collectStub), 0755); err != nil {
+		t.Fatal(err)
+	}
+	hostsFile := filepath.Join(dir, "hosts")
+	hosts := "# hypervisors\nkvm09.example.com\nkvm43.example.com kvm10.example.com\n\nkvm21.example.com\nkvm30.example.com # hangs\n"
+	if err := ioutil.WriteFile(hostsFile, []byte(hosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := newCollectSource(nil, hostsFile, stub+" {host}", time.Second, 2)
+	if err != nil {
+		t.Fatalf("newCollectSource() returned an error unexpectedly: %v", err)
+	}
+	start := time.Now()
+	vmap, diags, err := LoadSource(src)
+	if err != nil {
+		t.Fatalf("LoadSource() returned an error unexpectedly: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("LoadSource() waited %v for the hung host", elapsed)
+	}
+	name := "collect:" + hostsFile
+	expected := &Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": VHost{State: "up", Guests: []string{"olh", "tam"}, Source: name},
+			"kvm43.example.com": VHost{State: "up", Guests: []string{"compute-64"}, Source: name},
+			"kvm10.example.com": VHost{State: "up", Status: HostCommandFailed, Error: "error: failed to connect to the hypervisor", Source: name},
+			"kvm21.example.com": VHost{State: "down", Status: HostUnreachableDNS, Error: "ssh: Could not resolve hostname kvm21.example.com: Name or service not known", Source: name},
+			"kvm30.example.com": VHost{State: "down", Status: HostTimeout, Error: "Command timed out after 1s", Source: name},
+		},
+		Guests: map[string]VGuest{
+			"tam":        VGuest{State: "running", Host: "kvm09.example.com", Source: name},
+			"olh":        VGuest{State: "shut off", Host: "kvm09.example.com", Source: name},
+			"compute-64": VGuest{State: "paused", Host: "kvm43.example.com", Source: name},
+		},
+	}
+	if !reflect.DeepEqual(vmap, expected) {
+		t.Fatalf("LoadSource() failed.\nGot:\n%#v\nExpected:\n%#v", vmap, expected)
+	}
+	if len(diags) != 3 {
+		t.Fatalf("LoadSource() returned %d diagnostics, expected one for each failed host: %v", len(diags), diags)
+	}
+}
+
+func TestNewCollectSource(t *testing.T) {
+	tests := []struct {
+		hosts   []string
+		file    string
+		command string
+		error   string
+	}{
+		{[]string{"kvm09.example.com"}, "", CollectCommand, ""},
+		{nil, "/etc/virtmapper/hosts", CollectCommand, ""},
+		{nil, "", CollectCommand, "No hosts to collect from"},
+		{[]string{"kvm09.example.com"}, "", "virsh list --all", "Bad collect command, it has no {host}: virsh list --all"},
+	}
+	for _, test := range tests {
+		t.Run(test.command, func(t *testing.T) {
+			_, err := newCollectSource(test.hosts, test.file, test.command, time.Second, 1)
+			if test.error == "" && err != nil {
+				t.Fatalf("newCollectSource() returned an error unexpectedly: %v", err)
+			}
+			if test.error != "" && (err == nil || err.Error() != test.error) {
+				t.Fatalf("newCollectSource() returned the wrong error\nGot:\n%v\nExpected:\n%v", err, test.error)
+			}
+		})
+	}
+}
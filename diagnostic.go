@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Severity is how serious a Diagnostic is
+type Severity string
+
+// Diagnostic severities.  Warnings are expected in normal operation,
+// e.g. a host which is down, while errors mean the map is wrong.
+const (
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+// Diagnostic describes a problem found while parsing a source.
+// Line is the line number of Text in the source, or 0 when it isn't
+// known, e.g. for JSON output.
+type Diagnostic struct {
+	Source   string   `json:"source,omitempty"`
+	Line     int      `json:"line,omitempty"`
+	Text     string   `json:"text"`
+	Reason   string   `json:"reason"`
+	Severity Severity `json:"severity"`
+}
+
+// String formats the Diagnostic like a compiler message,
+// e.g. "file:/tmp/virtmapper.txt:12: error: reason: text"
+func (d Diagnostic) String() string {
+	location := d.Source
+	if d.Line > 0 {
+		location = fmt.Sprintf("%s:%d", location, d.Line)
+	}
+	return fmt.Sprintf("%s: %s: %s: %q", location, d.Severity, d.Reason, d.Text)
+}
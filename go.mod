@@ -2,4 +2,9 @@ module github.com/derekcrovo/virtmapper
 
 go 1.14
 
-require github.com/urfave/cli v1.22.2
+require (
+	github.com/fsnotify/fsnotify v1.5.1
+	github.com/urfave/cli v1.22.2
+	golang.org/x/sys v0.7.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
+)
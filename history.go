@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// historyFile is the name of the history in the state directory
+const historyFile = "history.jsonl"
+
+// GuestChange is the kind of a change to a guest
+type GuestChange string
+
+// The kinds of changes to guests
+const (
+	GuestAdded        GuestChange = "added"
+	GuestRemoved      GuestChange = "removed"
+	GuestMoved        GuestChange = "moved"
+	GuestStateChanged GuestChange = "state-changed"
+)
+
+// GuestEvent is a change to a guest seen at a reload or a report.  Host
+// and State are those of the guest after the change, and PreviousHost and
+// PreviousState those before it.  A removed guest has no Host or State.
+type GuestEvent struct {
+	Time          time.Time   `json:"time"`
+	Guest         string      `json:"guest"`
+	Change        GuestChange `json:"change"`
+	Host          string      `json:"host,omitempty"`
+	State         GuestState  `json:"state,omitempty"`
+	PreviousHost  string      `json:"previous_host,omitempty"`
+	PreviousState GuestState  `json:"previous_state,omitempty"`
+}
+
+// String describes the event for the history command
+func (e GuestEvent) String() string {
+	when := e.Time.Local().Format("2006-01-02 15:04:05")
+	switch e.Change {
+	case GuestAdded:
+		return fmt.Sprintf("%s %s added on %s, %s", when, e.Guest, e.Host, e.State)
+	case GuestRemoved:
+		return fmt.Sprintf("%s %s removed from %s", when, e.Guest, e.PreviousHost)
+	case GuestMoved:
+		return fmt.Sprintf("%s %s moved from %s to %s, %s", when, e.Guest, e.PreviousHost, e.Host, e.State)
+	}
+	return fmt.Sprintf("%s %s %s on %s, was %s", when, e.Guest, e.State, e.Host, e.PreviousState)
+}
+
+// history records the changes to the guests of the map, so the map can be
+// rebuilt as it was at any time since.  The events are appended to a file
+// of JSON lines, if path is set, and kept in memory by guest.
+type history struct {
+	sync.Mutex
+	path   string
+	events map[string][]GuestEvent
+
+	// Events older than retention are compacted away, see compact
+	retention time.Duration
+	since     time.Time // Earliest time the map can be rebuilt at
+	compacted time.Time // Time of the last compaction
+}
+
+// openHistory reads the history in the file at path, which may not exist
+// yet, and compacts it to the retention period, 0 for no limit.  Lines
+// which can't be read, such as the last line written before a crash,
+// are logged and skipped.
+func openHistory(path string, retention time.Duration) (*history, error) {
+	h := &history{path: path, events: make(map[string][]GuestEvent), retention: retention}
+	if path == "" {
+		return h, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		var e GuestEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Printf("Skipping history line %s:%d: %v", path, n, err)
+			continue
+		}
+		h.events[e.Guest] = append(h.events[e.Guest], e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, h.compact(time.Now().UTC())
+}
+
+// compact drops the events from before the retention period.  The last
+// event of each guest before then is kept, unless the guest had been
+// removed, so the map can still be rebuilt at any time since, and the
+// guests which were removed before then are forgotten.  The history file
+// is rewritten with the events which are left.
+func (h *history) compact(now time.Time) error {
+	if h.retention <= 0 {
+		return nil
+	}
+	h.since, h.compacted = now.Add(-h.retention), now
+	dropped := 0
+	for name, events := range h.events {
+		i := 0
+		for i < len(events) && events[i].Time.Before(h.since) {
+			i++
+		}
+		if i == 0 {
+			continue
+		}
+		kept := events[i-1:]
+		if events[i-1].Change == GuestRemoved {
+			kept = events[i:]
+		}
+		dropped += len(events) - len(kept)
+		if len(kept) == 0 {
+			delete(h.events, name)
+			continue
+		}
+		h.events[name] = append([]GuestEvent(nil), kept...)
+	}
+	if dropped == 0 {
+		return nil
+	}
+	log.Printf("Compacted the history to the events since %s, %d dropped", h.since.Format(time.RFC3339), dropped)
+	return h.rewrite()
+}
+
+// rewrite replaces the history file with the events in memory, oldest
+// first.  The new file is renamed into place, so a crash can't lose it.
+func (h *history) rewrite() error {
+	if h.path == "" {
+		return nil
+	}
+	var events []GuestEvent
+	for _, e := range h.events {
+		events = append(events, e...)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if !events[i].Time.Equal(events[j].Time) {
+			return events[i].Time.Before(events[j].Time)
+		}
+		return events[i].Guest < events[j].Guest
+	})
+	tmp := h.path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := writeEvents(tmp, events); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// record records how the guests of v differ from the last recorded state
+// of the map, as changes made at the given time.  While any of the sources
+// of v failed to load, a guest missing from v is only recorded as removed
+// if its host was loaded, as otherwise it may just not have been seen.
+func (h *history) record(v *Vmap, at time.Time) error {
+	h.Lock()
+	defer h.Unlock()
+	failed := make(map[string]bool)
+	for _, src := range v.Sources {
+		if src.Error != "" {
+			failed[src.Name] = true
+		}
+	}
+	var events []GuestEvent
+	for name, g := range v.Guests {
+		e := GuestEvent{Time: at, Guest: name, Host: g.Host, State: g.State}
+		last, ok := h.last(name)
+		// A guest still defined on its last host hasn't moved
+		if p, still := g.placementOn(last.Host); ok && last.Change != GuestRemoved && still {
+			e.Host, e.State = p.Host, p.State
+		}
+		switch {
+		case !ok || last.Change == GuestRemoved:
+			e.Change = GuestAdded
+		case last.Host != e.Host:
+			e.Change, e.PreviousHost, e.PreviousState = GuestMoved, last.Host, last.State
+		case last.State != e.State:
+			e.Change, e.PreviousHost, e.PreviousState = GuestStateChanged, last.Host, last.State
+		default:
+			continue
+		}
+		events = append(events, e)
+	}
+	for name := range h.events {
+		if _, ok := v.Guests[name]; ok {
+			continue
+		}
+		last, _ := h.last(name)
+		if last.Change == GuestRemoved {
+			continue
+		}
+		if host, ok := v.Hosts[last.Host]; len(failed) > 0 && (!ok || failed[host.Source]) {
+			continue
+		}
+		events = append(events, GuestEvent{Time: at, Guest: name, Change: GuestRemoved, PreviousHost: last.Host, PreviousState: last.State})
+	}
+	if len(events) > 0 {
+		sort.Slice(events, func(i, j int) bool { return events[i].Guest < events[j].Guest })
+		for _, e := range events {
+			h.events[e.Guest] = append(h.events[e.Guest], e)
+		}
+		if h.path != "" {
+			if err := writeEvents(h.path, events); err != nil {
+				return err
+			}
+		}
+	}
+	if at.Sub(h.compacted) >= HistoryCompactInterval*time.Hour {
+		return h.compact(at)
+	}
+	return nil
+}
+
+// writeEvents writes events to the end of the history file at path
+func writeEvents(path string, events []GuestEvent) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// last returns the last event of a guest
+func (h *history) last(name string) (GuestEvent, bool) {
+	events := h.events[name]
+	if len(events) == 0 {
+		return GuestEvent{}, false
+	}
+	return events[len(events)-1], true
+}
+
+// start returns the earliest time the map can be rebuilt at, which is
+// zero if the history is kept for ever
+func (h *history) start() time.Time {
+	h.Lock()
+	defer h.Unlock()
+	return h.since
+}
+
+// guestEvents returns the events of a guest, oldest first
+func (h *history) guestEvents(name string) []GuestEvent {
+	h.Lock()
+	defer h.Unlock()
+	return append([]GuestEvent(nil), h.events[name]...)
+}
+
+// mapAt rebuilds the map as it was at the given time from the events.
+// Each guest is on the host and in the state of its last event before
+// then, and each host has the guests on it.
+func (h *history) mapAt(at time.Time) *Vmap {
+	h.Lock()
+	defer h.Unlock()
+	v := &Vmap{
+		Hosts:  make(map[string]VHost),
+		Guests: make(map[string]VGuest),
+	}
+	for name, events := range h.events {
+		var e *GuestEvent
+		for i := range events {
+			if !events[i].Time.After(at) {
+				e = &events[i]
+			}
+		}
+		if e == nil || e.Change == GuestRemoved {
+			continue
+		}
+		v.Guests[name] = VGuest{State: e.State, Host: e.Host}
+		host := v.Hosts[e.Host]
+		host.Guests = append(host.Guests, name)
+		v.Hosts[e.Host] = host
+	}
+	for name, host := range v.Hosts {
+		sort.Strings(host.Guests)
+		v.Hosts[name] = host
+	}
+	return v
+}
+
+// parseTime parses a time given in a query, either in RFC 3339 format
+// or as a date and time without a time zone, in local time
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Bad time %q, expected e.g. 2026-09-01T12:00", s)
+}
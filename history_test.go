@@ -0,0 +1,276 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// historyMaps are the maps at successive reloads, an hour apart
+var historyMaps = []*Vmap{
+	{Guests: map[string]VGuest{
+		"tam": {State: GuestRunning, Host: "kvm09.example.com"},
+		"olh": {State: GuestShutOff, Host: "kvm09.example.com"},
+	}},
+	{Guests: map[string]VGuest{
+		"tam": {State: GuestRunning, Host: "kvm43.example.com"},
+		"olh": {State: GuestShutOff, Host: "kvm09.example.com"},
+	}},
+	{Guests: map[string]VGuest{
+		"tam": {State: GuestPaused, Host: "kvm43.example.com"},
+	}},
+	{Guests: map[string]VGuest{
+		"tam": {State: GuestPaused, Host: "kvm43.example.com"},
+		"olh": {State: GuestRunning, Host: "kvm09.example.com"},
+	}},
+}
+
+var historyStart = time.Date(2026, 9, 1, 10, 0, 0, 0, time.UTC)
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state", historyFile)
+	h, err := openHistory(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range historyMaps {
+		if err := h.record(v, historyStart.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatalf("record() returned an error unexpectedly: %v", err)
+		}
+	}
+	// Recording an unchanged map adds nothing
+	if err := h.record(historyMaps[3], historyStart.Add(4*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash left half a line at the end
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2026-09-01T`)
+	f.Close()
+	h, err = openHistory(path, 0)
+	if err != nil {
+		t.Fatalf("openHistory() returned an error unexpectedly: %v", err)
+	}
+
+	expected := []GuestEvent{
+		{Time: historyStart, Guest: "olh", Change: GuestAdded, Host: "kvm09.example.com", State: GuestShutOff},
+		{Time: historyStart.Add(2 * time.Hour), Guest: "olh", Change: GuestRemoved, PreviousHost: "kvm09.example.com", PreviousState: GuestShutOff},
+		{Time: historyStart.Add(3 * time.Hour), Guest: "olh", Change: GuestAdded, Host: "kvm09.example.com", State: GuestRunning},
+	}
+	if got := h.guestEvents("olh"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", got, expected)
+	}
+	expected = []GuestEvent{
+		{Time: historyStart, Guest: "tam", Change: GuestAdded, Host: "kvm09.example.com", State: GuestRunning},
+		{Time: historyStart.Add(time.Hour), Guest: "tam", Change: GuestMoved, Host: "kvm43.example.com", State: GuestRunning, PreviousHost: "kvm09.example.com", PreviousState: GuestRunning},
+		{Time: historyStart.Add(2 * time.Hour), Guest: "tam", Change: GuestStateChanged, Host: "kvm43.example.com", State: GuestPaused, PreviousHost: "kvm43.example.com", PreviousState: GuestRunning},
+	}
+	if got := h.guestEvents("tam"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", got, expected)
+	}
+
+	tests := []struct {
+		at       time.Time
+		expected *Vmap
+	}{
+		{historyStart.Add(-time.Minute), &Vmap{Hosts: map[string]VHost{}, Guests: map[string]VGuest{}}},
+		{historyStart.Add(90 * time.Minute), &Vmap{
+			Hosts: map[string]VHost{
+				"kvm09.example.com": {Guests: []string{"olh"}},
+				"kvm43.example.com": {Guests: []string{"tam"}},
+			},
+			Guests: map[string]VGuest{
+				"tam": {State: GuestRunning, Host: "kvm43.example.com"},
+				"olh": {State: GuestShutOff, Host: "kvm09.example.com"},
+			},
+		}},
+		{historyStart.Add(2 * time.Hour), &Vmap{
+			Hosts: map[string]VHost{
+				"kvm43.example.com": {Guests: []string{"tam"}},
+			},
+			Guests: map[string]VGuest{
+				"tam": {State: GuestPaused, Host: "kvm43.example.com"},
+			},
+		}},
+	}
+	for _, test := range tests {
+		if got := h.mapAt(test.at); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("At %v got:\n%#v\nExpected:\n%#v", test.at, got, test.expected)
+		}
+	}
+}
+
+func TestHistoryPlacements(t *testing.T) {
+	h, err := openHistory("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maps := []*Vmap{
+		historyMaps[0],
+		// tam is also defined on kvm43, where it is running
+		{Guests: map[string]VGuest{
+			"tam": {State: GuestRunning, Host: "kvm43.example.com", Placements: []Placement{
+				{Host: "kvm43.example.com", State: GuestRunning},
+				{Host: "kvm09.example.com", State: GuestShutOff},
+			}},
+			"olh": {State: GuestShutOff, Host: "kvm09.example.com"},
+		}},
+		// and is no longer defined on kvm09
+		historyMaps[1],
+	}
+	for i, v := range maps {
+		if err := h.record(v, historyStart.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []GuestEvent{
+		{Time: historyStart, Guest: "tam", Change: GuestAdded, Host: "kvm09.example.com", State: GuestRunning},
+		{Time: historyStart.Add(time.Hour), Guest: "tam", Change: GuestStateChanged, Host: "kvm09.example.com", State: GuestShutOff, PreviousHost: "kvm09.example.com", PreviousState: GuestRunning},
+		{Time: historyStart.Add(2 * time.Hour), Guest: "tam", Change: GuestMoved, Host: "kvm43.example.com", State: GuestRunning, PreviousHost: "kvm09.example.com", PreviousState: GuestShutOff},
+	}
+	if got := h.guestEvents("tam"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", got, expected)
+	}
+}
+
+func TestHistoryCompact(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, historyFile)
+	h, err := openHistory(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range historyMaps {
+		if err := h.record(v, historyStart.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := h.mapAt(historyStart.Add(150 * time.Minute))
+
+	// Keep the events since 2h30, olh was removed before then
+	h.retention = 90 * time.Minute
+	if err := h.compact(historyStart.Add(4 * time.Hour)); err != nil {
+		t.Fatalf("compact() returned an error unexpectedly: %v", err)
+	}
+	expected := map[string][]GuestEvent{
+		"olh": {{Time: historyStart.Add(3 * time.Hour), Guest: "olh", Change: GuestAdded, Host: "kvm09.example.com", State: GuestRunning}},
+		"tam": {{Time: historyStart.Add(2 * time.Hour), Guest: "tam", Change: GuestStateChanged, Host: "kvm43.example.com", State: GuestPaused, PreviousHost: "kvm43.example.com", PreviousState: GuestRunning}},
+	}
+	if !reflect.DeepEqual(h.events, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", h.events, expected)
+	}
+	if got := h.mapAt(historyStart.Add(150 * time.Minute)); !reflect.DeepEqual(got, before) {
+		t.Errorf("The map changed at the start of the history\nGot:\n%#v\nExpected:\n%#v", got, before)
+	}
+
+	// The file was rewritten, and is compacted again when it is opened
+	h, err = openHistory(path, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h.events, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", h.events, expected)
+	}
+	if since := time.Since(h.start()); since < 24*time.Hour || since > 25*time.Hour {
+		t.Errorf("The history starts %v ago, expected a day ago", since)
+	}
+
+	// The map can't be rebuilt from before the history starts
+	s := newServer(nil, nil)
+	s.history = h
+	response := httptest.NewRecorder()
+	s.handleRequest(response, httptest.NewRequest("GET", "/api/v1/vmap/?at=2026-09-01T12:00:00Z", nil))
+	if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), "The history only goes back to") {
+		t.Errorf("Got status %d for a time before the history: %s", response.Code, response.Body)
+	}
+}
+
+func TestHistoryFailedSources(t *testing.T) {
+	h, err := openHistory("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := []SourceInfo{{Name: "file:dc1.txt"}, {Name: "file:dc2.txt"}}
+	if err := h.record(&Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": {State: "up", Guests: []string{"tam"}, Source: "file:dc1.txt"},
+			"kvm11.example.com": {State: "up", Guests: []string{"olh"}, Source: "file:dc2.txt"},
+		},
+		Guests: map[string]VGuest{
+			"tam": {State: GuestRunning, Host: "kvm09.example.com", Source: "file:dc1.txt"},
+			"olh": {State: GuestRunning, Host: "kvm11.example.com", Source: "file:dc2.txt"},
+		},
+		Sources: loaded,
+	}, historyStart); err != nil {
+		t.Fatal(err)
+	}
+
+	// No source loaded, so nothing is known to be removed
+	failed := []SourceInfo{{Name: "file:dc1.txt", Error: "no such file or directory"}, {Name: "file:dc2.txt", Error: "no such file or directory"}}
+	if err := h.record(&Vmap{Sources: failed}, historyStart.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.guestEvents("tam"); len(got) != 1 {
+		t.Errorf("tam was recorded as removed while its source failed: %#v", got)
+	}
+
+	// dc1 loaded without tam, and dc2 failed
+	partial := []SourceInfo{{Name: "file:dc1.txt"}, {Name: "file:dc2.txt", Error: "no such file or directory"}}
+	if err := h.record(&Vmap{
+		Hosts:   map[string]VHost{"kvm09.example.com": {State: "up", Source: "file:dc1.txt"}},
+		Guests:  map[string]VGuest{},
+		Sources: partial,
+	}, historyStart.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.guestEvents("tam"); len(got) != 2 || got[1].Change != GuestRemoved {
+		t.Errorf("tam wasn't recorded as removed from its loaded host: %#v", got)
+	}
+	if got := h.guestEvents("olh"); len(got) != 1 {
+		t.Errorf("olh was recorded as removed while its source failed: %#v", got)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected time.Time
+		err      string
+	}{
+		{"2026-09-01T12:00:00Z", time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC), ""},
+		{"2026-09-01T14:00:00+02:00", time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC), ""},
+		{"2026-09-01T12:00", time.Date(2026, 9, 1, 12, 0, 0, 0, time.Local), ""},
+		{"2026-09-01 12:00:30", time.Date(2026, 9, 1, 12, 0, 30, 0, time.Local), ""},
+		{"2026-09-01", time.Date(2026, 9, 1, 0, 0, 0, 0, time.Local), ""},
+		{"yesterday", time.Time{}, `Bad time "yesterday", expected e.g. 2026-09-01T12:00`},
+	}
+	for _, test := range tests {
+		got, err := parseTime(test.s)
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("%s: got error %v, expected %q", test.s, err, test.err)
+		}
+		if !got.Equal(test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.s, got, test.expected)
+		}
+	}
+}
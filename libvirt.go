@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Libvirt connection defaults
+const (
+	libvirtSocket  = "/var/run/libvirt/libvirt-sock"
+	libvirtTCPPort = "16509"
+	libvirtTimeout = 30 * time.Second
+)
+
+// libvirtSource connects to the libvirtd of each hypervisor itself over
+// the libvirt remote protocol, rather than reading "virsh list" output.
+// The spec is a comma separated list of libvirt URIs using the unix, tcp
+// or ssh transports, e.g. "qemu+tcp://kvm09.example.com/system".
+type libvirtSource struct {
+	spec    string
+	uris    []*url.URL
+	timeout time.Duration
+}
+
+func newLibvirtSource(spec string) (Source, error) {
+	src := &libvirtSource{spec: spec, timeout: libvirtTimeout}
+	for _, raw := range strings.Split(spec, ",") {
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil || u.Scheme == "" {
+			return nil, fmt.Errorf("Bad libvirt URI: %s", raw)
+		}
+		switch libvirtTransport(u) {
+		case "unix":
+		case "tcp", "ssh":
+			if u.Hostname() == "" {
+				return nil, fmt.Errorf("Bad libvirt URI, it has no host: %s", raw)
+			}
+		default:
+			return nil, fmt.Errorf("Bad libvirt URI, unsupported transport: %s", raw)
+		}
+		src.uris = append(src.uris, u)
+	}
+	return src, nil
+}
+
+func (l *libvirtSource) Name() string {
+	return "libvirt:" + l.spec
+}
+
+// libvirtHost is the result of listing the domains of one hypervisor.
+// Fetch encodes a list of them as JSON for Parse.  Reported is the time
+// of a host's report to the report endpoint.
+type libvirtHost struct {
+	Name     string          `json:"name"`
+	Domains  []libvirtDomain `json:"domains,omitempty"`
+	Status   HostStatus      `json:"status,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Reported *time.Time      `json:"reported,omitempty"`
+}
+
+type libvirtDomain struct {
+	Name      string     `json:"name"`
+	UUID      string     `json:"uuid"`
+	State     GuestState `json:"state"`
+	VCPUs     int        `json:"vcpus"`
+	MemoryKiB uint64     `json:"memory_kib"`
+}
+
+// Fetch lists the domains of all of the hypervisors, at most
+// CollectConcurrency at a time
+func (l *libvirtSource) Fetch() (io.ReadCloser, error) {
+	hosts := make([]libvirtHost, len(l.uris))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, CollectConcurrency)
+	for i, u := range l.uris {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, u *url.URL) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			hosts[i] = l.fetchHost(u)
+		}(i, u)
+	}
+	wg.Wait()
+	raw, err := json.Marshal(hosts)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(raw)), nil
+}
+
+// fetchHost lists the domains of one hypervisor.  Errors reaching the
+// host are classified like Ansible's, and errors from libvirtd itself
+// mean the host is up but its guests couldn't be listed.
+func (l *libvirtSource) fetchHost(u *url.URL) libvirtHost {
+	h := libvirtHost{Name: libvirtHostName(u)}
+	domains, err := l.listDomains(u)
+	if err == nil {
+		h.Domains = domains
+		return h
+	}
+	h.Error = err.Error()
+	h.Status = classifyHostError(h.Error)
+	var lerr *libvirtError
+	if errors.As(err, &lerr) && h.Status == HostUnknown {
+		h.Status = HostCommandFailed
+	}
+	return h
+}
+
+// listDomains connects to the hypervisor at u and lists its domains
+func (l *libvirtSource) listDomains(u *url.URL) ([]libvirtDomain, error) {
+	conn, err := dialLibvirt(u, l.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &libvirtClient{conn: conn}
+	defer c.close()
+	if err := c.open(libvirtDriverURI(u)); err != nil {
+		return nil, err
+	}
+	refs, err := c.listAllDomains()
+	if err != nil {
+		return nil, err
+	}
+	domains := make([]libvirtDomain, 0, len(refs))
+	for _, ref := range refs {
+		info, err := c.domainInfo(ref)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, libvirtDomain{
+			Name:      ref.Name,
+			UUID:      ref.UUIDString(),
+			State:     libvirtState(info.State),
+			VCPUs:     int(info.VCPUs),
+			MemoryKiB: info.Memory,
+		})
+	}
+	return domains, nil
+}
+
+// Parse builds the map from the hosts listed by Fetch
+func (l *libvirtSource) Parse(r io.Reader) (*Vmap, []Diagnostic, error) {
+	var hosts []libvirtHost
+	if err := json.NewDecoder(r).Decode(&hosts); err != nil {
+		return nil, nil, err
+	}
+	v, diags := parseLibvirtHosts(hosts)
+	return v, diags, nil
+}
+
+// parseLibvirtHosts builds a map from the domain lists of the hosts
+func parseLibvirtHosts(hosts []libvirtHost) (*Vmap, []Diagnostic) {
+	p := newAnsibleParser()
+	for _, h := range hosts {
+		status := h.Status
+		if status == "" {
+			status = HostUp
+		}
+		if d, bad := hostStatusDiagnostic(h.Name, status, 0, h.Error); bad {
+			p.diags = append(p.diags, d)
+		}
+		p.startHost(h.Name, status, h.Error)
+		for _, d := range h.Domains {
+			p.addGuest(0, d.Name, d.Name, d.State)
+			if g := p.v.Guests[d.Name]; g.Host == h.Name {
+				g.UUID, g.VCPUs, g.MemoryKiB = d.UUID, d.VCPUs, d.MemoryKiB
+				p.v.Guests[d.Name] = g
+			}
+		}
+		p.endHost()
+		if h.Reported != nil {
+			vh := p.v.Hosts[h.Name]
+			vh.Reported = h.Reported
+			p.v.Hosts[h.Name] = vh
+		}
+	}
+	return p.v, p.diags
+}
+
+// libvirtTransport returns the transport of a URI such as "qemu+ssh://...",
+// which is "unix" for local URIs
+func libvirtTransport(u *url.URL) string {
+	if i := strings.Index(u.Scheme, "+"); i >= 0 {
+		return u.Scheme[i+1:]
+	}
+	if u.Host == "" {
+		return "unix"
+	}
+	return "tls"
+}
+
+// libvirtDriverURI returns the URI opened on the remote libvirtd, which is
+// the URI without the transport and server, e.g. "qemu:///system"
+func libvirtDriverURI(u *url.URL) string {
+	driver := u.Scheme
+	if i := strings.Index(driver, "+"); i >= 0 {
+		driver = driver[:i]
+	}
+	path := u.Path
+	if path == "" {
+		path = "/system"
+	}
+	return driver + "://" + path
+}
+
+// libvirtHostName returns the name of the host of a URI
+// in the map, which is the local host for unix URIs
+func libvirtHostName(u *url.URL) string {
+	if name := u.Hostname(); name != "" {
+		return name
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return name
+}
+
+// dialLibvirt connects to the libvirtd of the URI.  The ssh transport runs
+// netcat on the host to reach its libvirtd socket, like libvirt itself.
+// The connection fails if it isn't finished within the timeout.
+func dialLibvirt(u *url.URL, timeout time.Duration) (io.ReadWriteCloser, error) {
+	socket := u.Query().Get("socket")
+	if socket == "" {
+		socket = libvirtSocket
+	}
+	var conn net.Conn
+	var err error
+	switch libvirtTransport(u) {
+	case "unix":
+		conn, err = net.DialTimeout("unix", socket, timeout)
+	case "tcp":
+		port := u.Port()
+		if port == "" {
+			port = libvirtTCPPort
+		}
+		conn, err = net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), timeout)
+	case "ssh":
+		return dialLibvirtSSH(u, socket, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	return conn, nil
+}
+
+// sshConn is a connection through the standard input and output of ssh
+type sshConn struct {
+	io.Reader
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr *syncBuffer
+	timer  *time.Timer
+}
+
+func dialLibvirtSSH(u *url.URL, socket string, timeout time.Duration) (io.ReadWriteCloser, error) {
+	netcat := u.Query().Get("netcat")
+	if netcat == "" {
+		netcat = "nc"
+	}
+	args := []string{"-T", "-e", "none", "-o", "BatchMode=yes"}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	if user := u.User.Username(); user != "" {
+		args = append(args, "-l", user)
+	}
+	if keyfile := u.Query().Get("keyfile"); keyfile != "" {
+		args = append(args, "-i", keyfile)
+	}
+	args = append(args, "--", u.Hostname(), netcat, "-U", socket)
+	cmd := exec.Command("ssh", args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	c := &sshConn{Reader: stdout, WriteCloser: stdin, cmd: cmd, stderr: &syncBuffer{}}
+	cmd.Stderr = c.stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c.timer = time.AfterFunc(timeout, func() { cmd.Process.Kill() })
+	return c, nil
+}
+
+// Read returns the error output of ssh, such as a connection
+// error, in place of the end of its output
+func (c *sshConn) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if err != nil {
+		if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+			err = errors.New(msg)
+		}
+	}
+	return n, err
+}
+
+func (c *sshConn) Close() error {
+	c.timer.Stop()
+	c.WriteCloser.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+// syncBuffer is a bytes.Buffer which may be written while it is read
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
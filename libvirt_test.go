@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewLibvirtSource(t *testing.T) {
+	tests := []struct {
+		spec  string
+		error string
+	}{
+		{"qemu:///system", ""},
+		{"qemu+unix:///system?socket=/run/libvirt/libvirt-sock", ""},
+		{"qemu+tcp://kvm09.example.com/system,qemu+ssh://root@kvm10.example.com:2222/system", ""},
+		{"qemu+tcp:///system", "Bad libvirt URI, it has no host: qemu+tcp:///system"},
+		{"qemu://kvm09.example.com/system", "Bad libvirt URI, unsupported transport: qemu://kvm09.example.com/system"},
+		{"kvm09.example.com", "Bad libvirt URI: kvm09.example.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			src, err := NewSource("libvirt:" + test.spec)
+			if test.error != "" {
+				if err == nil || err.Error() != test.error {
+					t.Fatalf("NewSource() returned the wrong error\nGot:\n%v\nExpected:\n%v", err, test.error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewSource() returned an error unexpectedly: %v", err)
+			}
+			if src.Name() != "libvirt:"+test.spec {
+				t.Fatalf("NewSource() returned the wrong source %s", src.Name())
+			}
+		})
+	}
+}
+
+func TestLibvirtDriverURI(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"qemu+ssh://root@kvm09.example.com/system": "qemu:///system",
+		"qemu+unix:///session?socket=/tmp/sock":    "qemu:///session",
+		"qemu+tcp://kvm09.example.com":             "qemu:///system",
+		"xen+tcp://kvm09.example.com:16510/system": "xen:///system",
+	} {
+		u, _ := url.Parse(raw)
+		if uri := libvirtDriverURI(u); uri != expected {
+			t.Fatalf("libvirtDriverURI(%s) failed, got %s, expected %s", raw, uri, expected)
+		}
+	}
+}
+
+func TestLibvirtSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The local hypervisor, on a unix socket
+	socket := filepath.Join(dir, "libvirt-sock")
+	local, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go (&mockLibvirtd{domains: mockDomains}).serve(local)
+	// A remote hypervisor which refuses the client
+	remote, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	go (&mockLibvirtd{openError: "authentication failed: access denied by policy"}).serve(remote)
+	// A remote hypervisor which isn't running libvirtd
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	spec := "qemu+unix:///system?socket=" + socket + ",qemu+tcp://" + remote.Addr().String() + "/system,qemu+tcp://localhost:" + port(closed) + "/system"
+	src, err := NewSource("libvirt:" + spec)
+	if err != nil {
+		t.Fatalf("NewSource() returned an error unexpectedly: %v", err)
+	}
+	vmap, diags, err := LoadSource(src)
+	if err != nil {
+		t.Fatalf("LoadSource() returned an error unexpectedly: %v", err)
+	}
+	hostname, _ := os.Hostname()
+	name := "libvirt:" + spec
+	expected := map[string]VGuest{
+		"tam": VGuest{State: GuestRunning, Host: hostname, UUID: "6f8e2a61-1b4c-4a3e-9d1f-0e6a5b2c7d90", VCPUs: 2, MemoryKiB: 2097152, Source: name},
+		"olh": VGuest{State: GuestShutOff, Host: hostname, UUID: "11223344-5566-7788-99aa-bbccddeeff00", VCPUs: 1, MemoryKiB: 1048576, Source: name},
+	}
+	if !reflect.DeepEqual(vmap.Guests, expected) {
+		t.Fatalf("LoadSource() returned the wrong guests.\nGot:\n%#v\nExpected:\n%#v", vmap.Guests, expected)
+	}
+	if h := vmap.Hosts[hostname]; h.State != "up" || !reflect.DeepEqual(h.Guests, []string{"olh", "tam"}) {
+		t.Fatalf("LoadSource() returned the wrong local host: %#v", h)
+	}
+	refused := VHost{State: "down", Status: HostAuthFailed, Error: "authentication failed: access denied by policy", Source: name}
+	if h := vmap.Hosts["127.0.0.1"]; !reflect.DeepEqual(h, refused) {
+		t.Fatalf("LoadSource() returned the wrong remote host.\nGot:\n%#v\nExpected:\n%#v", h, refused)
+	}
+	if h := vmap.Hosts["localhost"]; h.State != "down" || h.Status != HostUnknown || h.Error == "" {
+		t.Fatalf("LoadSource() returned the wrong unreachable host: %#v", h)
+	}
+	if len(vmap.Hosts) != 3 || len(diags) != 2 {
+		t.Fatalf("LoadSource() returned %d hosts and %d diagnostics: %#v %v", len(vmap.Hosts), len(diags), vmap.Hosts, diags)
+	}
+}
+
+func port(l net.Listener) string {
+	_, p, _ := net.SplitHostPort(l.Addr().String())
+	return p
+}
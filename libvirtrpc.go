@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The parts of the libvirt remote protocol needed to list the domains of
+// a hypervisor, from remote_protocol.x and virnetprotocol.x.  Messages are
+// XDR encoded and framed by their length, which includes itself.
+const (
+	libvirtProgram         = 0x20008086
+	libvirtProtocolVersion = 1
+
+	libvirtProcConnectOpen           = 1
+	libvirtProcConnectClose          = 2
+	libvirtProcDomainGetInfo         = 16
+	libvirtProcConnectListAllDomains = 273
+
+	libvirtCall  = 0
+	libvirtReply = 1
+
+	libvirtStatusOK    = 0
+	libvirtStatusError = 1
+
+	libvirtHeaderSize = 24
+	libvirtMaxMessage = 32 * 1024 * 1024
+)
+
+// libvirtStates are the guest states indexed by libvirt's virDomainState,
+// named as "virsh list" shows them
+var libvirtStates = []GuestState{
+	GuestNoState,
+	GuestRunning,
+	GuestIdle,
+	GuestPaused,
+	GuestInShutdown,
+	GuestShutOff,
+	GuestCrashed,
+	GuestPMSuspended,
+}
+
+// libvirtHeader is the header of every message
+type libvirtHeader struct {
+	Program uint32
+	Version uint32
+	Proc    int32
+	Type    int32
+	Serial  uint32
+	Status  int32
+}
+
+// writeLibvirtMessage writes a message with its length
+func writeLibvirtMessage(w io.Writer, h libvirtHeader, body []byte) error {
+	buf := make([]byte, 4, 4+libvirtHeaderSize+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(4+libvirtHeaderSize+len(body)))
+	for _, v := range []uint32{h.Program, h.Version, uint32(h.Proc), uint32(h.Type), h.Serial, uint32(h.Status)} {
+		buf = append(buf, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], v)
+	}
+	_, err := w.Write(append(buf, body...))
+	return err
+}
+
+// readLibvirtMessage reads the next message
+func readLibvirtMessage(r io.Reader) (libvirtHeader, []byte, error) {
+	var h libvirtHeader
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return h, nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4+libvirtHeaderSize || n > libvirtMaxMessage {
+		return h, nil, fmt.Errorf("Bad libvirt message length %d", n)
+	}
+	msg := make([]byte, n-4)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return h, nil, err
+	}
+	d := &xdrDecoder{b: msg}
+	h = libvirtHeader{d.uint32(), d.uint32(), d.int32(), d.int32(), d.uint32(), d.int32()}
+	return h, msg[libvirtHeaderSize:], nil
+}
+
+// xdrEncoder encodes the XDR types used by the protocol
+type xdrEncoder struct {
+	bytes.Buffer
+}
+
+func (e *xdrEncoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *xdrEncoder) int32(v int32) {
+	e.uint32(uint32(v))
+}
+
+func (e *xdrEncoder) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.Write(b[:])
+}
+
+// fixed writes fixed length opaque data, padded to four bytes
+func (e *xdrEncoder) fixed(b []byte) {
+	e.Write(b)
+	e.Write(make([]byte, (4-len(b)%4)%4))
+}
+
+func (e *xdrEncoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.fixed([]byte(s))
+}
+
+// optionalString writes a string which may be NULL
+func (e *xdrEncoder) optionalString(s string, ok bool) {
+	if !ok {
+		e.uint32(0)
+		return
+	}
+	e.uint32(1)
+	e.string(s)
+}
+
+// xdrDecoder decodes the XDR types used by the protocol.  The first error
+// is kept in err and later reads return zero values.
+type xdrDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *xdrDecoder) next(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = fmt.Errorf("Short libvirt message")
+		return make([]byte, n)
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *xdrDecoder) uint32() uint32 {
+	return binary.BigEndian.Uint32(d.next(4))
+}
+
+func (d *xdrDecoder) int32() int32 {
+	return int32(d.uint32())
+}
+
+func (d *xdrDecoder) uint64() uint64 {
+	return binary.BigEndian.Uint64(d.next(8))
+}
+
+func (d *xdrDecoder) fixed(n int) []byte {
+	b := d.next(n)
+	d.next((4 - n%4) % 4)
+	return b
+}
+
+func (d *xdrDecoder) string() string {
+	n := d.uint32()
+	if n > uint32(len(d.b)) {
+		d.err = fmt.Errorf("Short libvirt message")
+		return ""
+	}
+	return string(d.fixed(int(n)))
+}
+
+func (d *xdrDecoder) optionalString() string {
+	if d.uint32() == 0 {
+		return ""
+	}
+	return d.string()
+}
+
+// libvirtError is an error returned by libvirtd
+type libvirtError struct {
+	Code    int32
+	Domain  int32
+	Message string
+}
+
+func (e *libvirtError) Error() string {
+	return e.Message
+}
+
+// libvirtDomainRef identifies a domain in calls, as remote_nonnull_domain
+type libvirtDomainRef struct {
+	Name string
+	UUID [16]byte
+	ID   int32
+}
+
+func (e *xdrEncoder) domain(d libvirtDomainRef) {
+	e.string(d.Name)
+	e.fixed(d.UUID[:])
+	e.int32(d.ID)
+}
+
+func (d *xdrDecoder) domain() libvirtDomainRef {
+	ref := libvirtDomainRef{Name: d.string()}
+	copy(ref.UUID[:], d.fixed(16))
+	ref.ID = d.int32()
+	return ref
+}
+
+// UUIDString formats the domain's UUID as libvirt shows it
+func (d libvirtDomainRef) UUIDString() string {
+	u := d.UUID
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// libvirtDomainInfo is the result of virDomainGetInfo.  Memory is in KiB.
+type libvirtDomainInfo struct {
+	State     uint8
+	MaxMemory uint64
+	Memory    uint64
+	VCPUs     uint16
+	CPUTime   uint64
+}
+
+// libvirtClient makes calls to libvirtd over a connection
+type libvirtClient struct {
+	conn   io.ReadWriteCloser
+	serial uint32
+}
+
+// call makes a call and returns the body of its reply
+func (c *libvirtClient) call(proc int32, args []byte) ([]byte, error) {
+	c.serial++
+	h := libvirtHeader{Program: libvirtProgram, Version: libvirtProtocolVersion, Proc: proc, Type: libvirtCall, Serial: c.serial}
+	if err := writeLibvirtMessage(c.conn, h, args); err != nil {
+		return nil, err
+	}
+	for {
+		reply, body, err := readLibvirtMessage(c.conn)
+		if err != nil {
+			return nil, err
+		}
+		// Skip anything else, such as events
+		if reply.Program != libvirtProgram || reply.Type != libvirtReply || reply.Serial != c.serial {
+			continue
+		}
+		if reply.Status == libvirtStatusError {
+			d := &xdrDecoder{b: body}
+			e := &libvirtError{Code: d.int32(), Domain: d.int32(), Message: d.optionalString()}
+			if d.err != nil {
+				return nil, d.err
+			}
+			return nil, e
+		}
+		return body, nil
+	}
+}
+
+// open opens the connection to the hypervisor driver named by uri,
+// e.g. "qemu:///system"
+func (c *libvirtClient) open(uri string) error {
+	var e xdrEncoder
+	e.optionalString(uri, true)
+	e.uint32(0)
+	_, err := c.call(libvirtProcConnectOpen, e.Bytes())
+	return err
+}
+
+// listAllDomains lists the active and inactive domains
+func (c *libvirtClient) listAllDomains() ([]libvirtDomainRef, error) {
+	var e xdrEncoder
+	e.int32(1)
+	e.uint32(0)
+	body, err := c.call(libvirtProcConnectListAllDomains, e.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	d := &xdrDecoder{b: body}
+	n := d.uint32()
+	var domains []libvirtDomainRef
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		domains = append(domains, d.domain())
+	}
+	return domains, d.err
+}
+
+// domainInfo returns the state, vCPUs and memory of a domain
+func (c *libvirtClient) domainInfo(dom libvirtDomainRef) (libvirtDomainInfo, error) {
+	var e xdrEncoder
+	e.domain(dom)
+	body, err := c.call(libvirtProcDomainGetInfo, e.Bytes())
+	if err != nil {
+		return libvirtDomainInfo{}, err
+	}
+	d := &xdrDecoder{b: body}
+	info := libvirtDomainInfo{
+		State:     uint8(d.uint32()),
+		MaxMemory: d.uint64(),
+		Memory:    d.uint64(),
+		VCPUs:     uint16(d.uint32()),
+		CPUTime:   d.uint64(),
+	}
+	return info, d.err
+}
+
+// close closes the hypervisor connection, then the connection itself
+func (c *libvirtClient) close() error {
+	_, err := c.call(libvirtProcConnectClose, nil)
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// libvirtState returns the GuestState of a virDomainState
+func libvirtState(state uint8) GuestState {
+	if int(state) < len(libvirtStates) {
+		return libvirtStates[state]
+	}
+	return GuestState(fmt.Sprintf("state %d", state))
+}
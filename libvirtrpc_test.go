@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// mockLibvirtd answers the calls made by libvirtClient, like the libvirtd
+// of a hypervisor with the domains.  openError, if set, fails the
+// connection to the hypervisor driver.
+type mockLibvirtd struct {
+	domains   []mockDomain
+	openError string
+	opened    chan string
+}
+
+type mockDomain struct {
+	ref  libvirtDomainRef
+	info libvirtDomainInfo
+}
+
+var mockDomains = []mockDomain{
+	{
+		libvirtDomainRef{"tam", [16]byte{0x6f, 0x8e, 0x2a, 0x61, 0x1b, 0x4c, 0x4a, 0x3e, 0x9d, 0x1f, 0x0e, 0x6a, 0x5b, 0x2c, 0x7d, 0x90}, 4},
+		libvirtDomainInfo{State: 1, MaxMemory: 4194304, Memory: 2097152, VCPUs: 2, CPUTime: 123456789},
+	},
+	{
+		libvirtDomainRef{"olh", [16]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00}, -1},
+		libvirtDomainInfo{State: 5, MaxMemory: 1048576, Memory: 1048576, VCPUs: 1},
+	},
+}
+
+func (m *mockLibvirtd) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go m.handle(conn)
+	}
+}
+
+func (m *mockLibvirtd) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		h, body, err := readLibvirtMessage(conn)
+		if err != nil {
+			return
+		}
+		reply := h
+		reply.Type = libvirtReply
+		var e xdrEncoder
+		fail := func(msg string) {
+			reply.Status = libvirtStatusError
+			e.Reset()
+			e.int32(1)
+			e.int32(0)
+			e.optionalString(msg, true)
+		}
+		d := &xdrDecoder{b: body}
+		switch h.Proc {
+		case libvirtProcConnectOpen:
+			if m.opened != nil {
+				m.opened <- d.optionalString()
+			}
+			if m.openError != "" {
+				fail(m.openError)
+			}
+		case libvirtProcConnectListAllDomains:
+			// An event the client must skip
+			event := libvirtHeader{Program: libvirtProgram, Version: libvirtProtocolVersion, Proc: 107, Type: 2}
+			if err := writeLibvirtMessage(conn, event, []byte{0, 0, 0, 0}); err != nil {
+				return
+			}
+			e.uint32(uint32(len(m.domains)))
+			for _, dom := range m.domains {
+				e.domain(dom.ref)
+			}
+			e.uint32(uint32(len(m.domains)))
+		case libvirtProcDomainGetInfo:
+			ref := d.domain()
+			fail("Domain not found: no domain with matching name '" + ref.Name + "'")
+			for _, dom := range m.domains {
+				if dom.ref == ref {
+					reply.Status = libvirtStatusOK
+					e.Reset()
+					e.uint32(uint32(dom.info.State))
+					e.uint64(dom.info.MaxMemory)
+					e.uint64(dom.info.Memory)
+					e.uint32(uint32(dom.info.VCPUs))
+					e.uint64(dom.info.CPUTime)
+				}
+			}
+		case libvirtProcConnectClose:
+		default:
+			fail("unsupported procedure")
+		}
+		if err := writeLibvirtMessage(conn, reply, e.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func TestXDR(t *testing.T) {
+	var e xdrEncoder
+	e.string("tam")
+	e.optionalString("", false)
+	e.optionalString("qemu:///system", true)
+	e.uint64(1 << 40)
+	e.domain(mockDomains[0].ref)
+	expected := []byte{0, 0, 0, 3, 't', 'a', 'm', 0, 0, 0, 0, 0}
+	if !reflect.DeepEqual(e.Bytes()[:len(expected)], expected) {
+		t.Fatalf("xdrEncoder failed.\nGot:\n%v\nExpected:\n%v", e.Bytes()[:len(expected)], expected)
+	}
+	d := &xdrDecoder{b: e.Bytes()}
+	if s := d.string(); s != "tam" {
+		t.Fatalf("xdrDecoder.string() failed, got %q", s)
+	}
+	if s := d.optionalString(); s != "" {
+		t.Fatalf("xdrDecoder.optionalString() failed, got %q", s)
+	}
+	if s := d.optionalString(); s != "qemu:///system" {
+		t.Fatalf("xdrDecoder.optionalString() failed, got %q", s)
+	}
+	if v := d.uint64(); v != 1<<40 {
+		t.Fatalf("xdrDecoder.uint64() failed, got %d", v)
+	}
+	if ref := d.domain(); ref != mockDomains[0].ref {
+		t.Fatalf("xdrDecoder.domain() failed.\nGot:\n%#v\nExpected:\n%#v", ref, mockDomains[0].ref)
+	}
+	if d.uint32(); d.err == nil {
+		t.Fatal("xdrDecoder didn't report the end of the data")
+	}
+}
+
+func TestLibvirtClient(t *testing.T) {
+	client, server := net.Pipe()
+	m := &mockLibvirtd{domains: mockDomains, opened: make(chan string, 1)}
+	go m.handle(server)
+	c := &libvirtClient{conn: client}
+	defer c.close()
+	if err := c.open("qemu:///system"); err != nil {
+		t.Fatalf("open() returned an error unexpectedly: %v", err)
+	}
+	if uri := <-m.opened; uri != "qemu:///system" {
+		t.Fatalf("open() sent the wrong URI %q", uri)
+	}
+	refs, err := c.listAllDomains()
+	if err != nil {
+		t.Fatalf("listAllDomains() returned an error unexpectedly: %v", err)
+	}
+	if !reflect.DeepEqual(refs, []libvirtDomainRef{mockDomains[0].ref, mockDomains[1].ref}) {
+		t.Fatalf("listAllDomains() failed.\nGot:\n%#v", refs)
+	}
+	if uuid := refs[0].UUIDString(); uuid != "6f8e2a61-1b4c-4a3e-9d1f-0e6a5b2c7d90" {
+		t.Fatalf("UUIDString() failed, got %s", uuid)
+	}
+	info, err := c.domainInfo(refs[0])
+	if err != nil {
+		t.Fatalf("domainInfo() returned an error unexpectedly: %v", err)
+	}
+	if info != mockDomains[0].info {
+		t.Fatalf("domainInfo() failed.\nGot:\n%#v\nExpected:\n%#v", info, mockDomains[0].info)
+	}
+	_, err = c.domainInfo(libvirtDomainRef{Name: "gone"})
+	if lerr, ok := err.(*libvirtError); !ok || lerr.Message != "Domain not found: no domain with matching name 'gone'" {
+		t.Fatalf("domainInfo() returned the wrong error: %v", err)
+	}
+}
+
+func TestLibvirtState(t *testing.T) {
+	for state, expected := range map[uint8]GuestState{1: GuestRunning, 2: GuestIdle, 4: GuestInShutdown, 5: GuestShutOff, 9: "state 9"} {
+		if s := libvirtState(state); s != expected {
+			t.Fatalf("libvirtState(%d) failed, got %q, expected %q", state, s, expected)
+		}
+	}
+}
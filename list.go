@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GuestEntry is a guest in a list of guests
+type GuestEntry struct {
+	Name string `json:"name"`
+	VGuest
+}
+
+// HostEntry is a host in a list of hosts
+type HostEntry struct {
+	Name string `json:"name"`
+	VHost
+}
+
+// GuestList is a page of a list of guests.  Total is the number
+// of guests which passed the filters, on all of the pages.
+type GuestList struct {
+	Guests []GuestEntry `json:"guests"`
+	Total  int          `json:"total"`
+	Offset int          `json:"offset"`
+	Limit  int          `json:"limit,omitempty"`
+}
+
+// HostList is a page of a list of hosts, like a GuestList
+type HostList struct {
+	Hosts  []HostEntry `json:"hosts"`
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit,omitempty"`
+}
+
+// listPage is the order and the page of a list.  The list is sorted by
+// the key and then by name, in reverse if desc is set.  A limit of 0
+// means the rest of the list.
+type listPage struct {
+	key    string
+	desc   bool
+	offset int
+	limit  int
+}
+
+// parseListPage parses the sort, offset and limit parameters of a
+// list request.  The sort key is one of keys, prefixed with "-" to
+// sort in descending order.
+func parseListPage(q url.Values, keys []string) (listPage, error) {
+	p := listPage{key: "name"}
+	if s := q.Get("sort"); s != "" {
+		p.key, p.desc = strings.TrimPrefix(s, "-"), strings.HasPrefix(s, "-")
+		if !containsString(keys, p.key) {
+			return p, fmt.Errorf("Bad sort %q, expected one of: %s", s, strings.Join(keys, ", "))
+		}
+	}
+	for _, param := range []struct {
+		name string
+		n    *int
+	}{{"offset", &p.offset}, {"limit", &p.limit}} {
+		s := q.Get(param.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("Bad %s %q, expected a number of entries", param.name, s)
+		}
+		*param.n = n
+	}
+	return p, nil
+}
+
+// bounds returns the bounds of the page in a list of n entries
+func (p listPage) bounds(n int) (int, int) {
+	start, end := p.offset, n
+	if start > n {
+		start = n
+	}
+	if p.limit > 0 && start+p.limit < end {
+		end = start + p.limit
+	}
+	return start, end
+}
+
+// less orders two entries by the result of comparing them by the sort
+// key, which is negative if a comes first, and then by their names
+func (p listPage) less(cmp int, a, b string) bool {
+	if cmp == 0 {
+		cmp = strings.Compare(a, b)
+	}
+	if p.desc {
+		cmp = -cmp
+	}
+	return cmp < 0
+}
+
+// globFilter returns a function which tells whether a name matches the
+// glob given in the parameter, or always true if it isn't given
+func globFilter(q url.Values, param string) (func(string) bool, error) {
+	glob := q.Get(param)
+	if glob == "" {
+		return func(string) bool { return true }, nil
+	}
+	return searchMatcher(glob, SearchGlob)
+}
+
+// boolParam parses a boolean filter parameter, which is nil if it isn't given
+func boolParam(q url.Values, param string) (*bool, error) {
+	s := q.Get(param)
+	if s == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, fmt.Errorf("Bad %s %q, expected true or false", param, s)
+	}
+	return &b, nil
+}
+
+// guestSortKeys are the keys a list of guests may be sorted by
+var guestSortKeys = []string{"name", "state", "host", "first_seen", "last_seen"}
+
+// listGuests returns the page of the guests in the map which pass the
+// filters in q.  name and host are globs matching the names of the guest
+// and its host, state may be given more than once to match any of the
+// states, hoststate is "up" or "down", stale is true or false, and label
+// may be given more than once for labels the guest must all have.
+func (v Vmap) listGuests(q url.Values) (*GuestList, error) {
+	page, err := parseListPage(q, guestSortKeys)
+	if err != nil {
+		return nil, err
+	}
+	name, err := globFilter(q, "name")
+	if err != nil {
+		return nil, err
+	}
+	host, err := globFilter(q, "host")
+	if err != nil {
+		return nil, err
+	}
+	var states []GuestState
+	for _, s := range q["state"] {
+		state, ok := ParseGuestState(s)
+		if !ok && state != GuestHostUnreachable {
+			return nil, fmt.Errorf("Bad state %q, expected a guest state such as running or shut off", s)
+		}
+		states = append(states, state)
+	}
+	hostState := q.Get("hoststate")
+	if hostState != "" && hostState != "up" && hostState != "down" {
+		return nil, fmt.Errorf("Bad hoststate %q, expected up or down", hostState)
+	}
+	stale, err := boolParam(q, "stale")
+	if err != nil {
+		return nil, err
+	}
+	labels, err := labelFilter(q)
+	if err != nil {
+		return nil, err
+	}
+
+	guests := []GuestEntry{}
+	for n, g := range v.Guests {
+		if !name(n) || !host(g.Host) || (stale != nil && g.Stale != *stale) || !labels(g.Labels) {
+			continue
+		}
+		if len(states) > 0 && !containsState(states, g.State) {
+			continue
+		}
+		if hostState != "" && v.Hosts[g.Host].State != hostState {
+			continue
+		}
+		guests = append(guests, GuestEntry{Name: n, VGuest: g})
+	}
+	sort.Slice(guests, func(i, j int) bool {
+		a, b := guests[i], guests[j]
+		var cmp int
+		switch page.key {
+		case "state":
+			cmp = strings.Compare(string(a.State), string(b.State))
+		case "host":
+			cmp = strings.Compare(a.Host, b.Host)
+		case "first_seen":
+			cmp = compareTimes(a.FirstSeen, b.FirstSeen)
+		case "last_seen":
+			cmp = compareTimes(a.LastSeen, b.LastSeen)
+		}
+		return page.less(cmp, a.Name, b.Name)
+	})
+	start, end := page.bounds(len(guests))
+	return &GuestList{Guests: guests[start:end], Total: len(guests), Offset: page.offset, Limit: page.limit}, nil
+}
+
+// hostStatuses are the statuses a list of hosts may be filtered by
+var hostStatuses = []string{
+	string(HostUp),
+	string(HostUnreachableDNS),
+	string(HostTimeout),
+	string(HostAuthFailed),
+	string(HostCommandFailed),
+	string(HostUnknown),
+}
+
+// hostSortKeys are the keys a list of hosts may be sorted by
+var hostSortKeys = []string{"name", "state", "guests", "first_seen", "last_seen"}
+
+// listHosts returns the page of the hosts in the map which pass the
+// filters in q.  name is a glob matching the name of the host, state is
+// "up" or "down", status may be given more than once to match any of the
+// statuses, and stale and label are as for guests.
+func (v Vmap) listHosts(q url.Values) (*HostList, error) {
+	page, err := parseListPage(q, hostSortKeys)
+	if err != nil {
+		return nil, err
+	}
+	name, err := globFilter(q, "name")
+	if err != nil {
+		return nil, err
+	}
+	state := q.Get("state")
+	if state != "" && state != "up" && state != "down" {
+		return nil, fmt.Errorf("Bad state %q, expected up or down", state)
+	}
+	statuses := q["status"]
+	for _, s := range statuses {
+		if !containsString(hostStatuses, s) {
+			return nil, fmt.Errorf("Bad status %q, expected one of: %s", s, strings.Join(hostStatuses, ", "))
+		}
+	}
+	stale, err := boolParam(q, "stale")
+	if err != nil {
+		return nil, err
+	}
+	labels, err := labelFilter(q)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []HostEntry{}
+	for n, h := range v.Hosts {
+		if !name(n) || (state != "" && h.State != state) || (stale != nil && h.Stale != *stale) || !labels(h.Labels) {
+			continue
+		}
+		status := h.Status
+		if status == "" {
+			status = HostUp
+		}
+		if len(statuses) > 0 && !containsString(statuses, string(status)) {
+			continue
+		}
+		hosts = append(hosts, HostEntry{Name: n, VHost: h})
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		a, b := hosts[i], hosts[j]
+		var cmp int
+		switch page.key {
+		case "state":
+			cmp = strings.Compare(a.State, b.State)
+		case "guests":
+			cmp = len(a.Guests) - len(b.Guests)
+		case "first_seen":
+			cmp = compareTimes(a.FirstSeen, b.FirstSeen)
+		case "last_seen":
+			cmp = compareTimes(a.LastSeen, b.LastSeen)
+		}
+		return page.less(cmp, a.Name, b.Name)
+	})
+	start, end := page.bounds(len(hosts))
+	return &HostList{Hosts: hosts[start:end], Total: len(hosts), Offset: page.offset, Limit: page.limit}, nil
+}
+
+// compareTimes compares two times, which come before all others if unknown
+func compareTimes(a, b *time.Time) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	case a.Before(*b):
+		return -1
+	case a.After(*b):
+		return 1
+	}
+	return 0
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsState(list []GuestState, s GuestState) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var listSeen = []time.Time{
+	time.Date(2026, 10, 18, 4, 0, 0, 0, time.UTC),
+	time.Date(2026, 10, 18, 5, 0, 0, 0, time.UTC),
+	time.Date(2026, 10, 18, 6, 0, 0, 0, time.UTC),
+}
+
+var listMap = Vmap{
+	Hosts: map[string]VHost{
+		"kvm09.example.com": {State: "up", Guests: []string{"olh", "tam"}, LastSeen: &listSeen[2]},
+		"kvm43.example.com": {State: "up", Guests: []string{"compute-64"}, LastSeen: &listSeen[1]},
+		"kvm44.example.com": {State: "down", Guests: []string{"compute-65"}, Status: HostTimeout, LastSeen: &listSeen[2], Stale: true},
+		"kvm21.example.com": {State: "down", Status: HostUnreachableDNS, LastSeen: &listSeen[0]},
+	},
+	Guests: map[string]VGuest{
+		"tam":        {State: GuestRunning, Host: "kvm09.example.com", LastSeen: &listSeen[2]},
+		"olh":        {State: GuestShutOff, Host: "kvm09.example.com", LastSeen: &listSeen[2]},
+		"compute-64": {State: GuestPaused, Host: "kvm43.example.com", LastSeen: &listSeen[1]},
+		"compute-65": {State: GuestHostUnreachable, Host: "kvm44.example.com", LastSeen: &listSeen[0], Stale: true},
+	},
+}
+
+func TestListGuests(t *testing.T) {
+	tests := []struct {
+		query string
+		names []string
+		total int
+		err   string
+	}{
+		{"", []string{"compute-64", "compute-65", "olh", "tam"}, 4, ""},
+		{"state=paused", []string{"compute-64"}, 1, ""},
+		{"state=running&state=shut+off", []string{"olh", "tam"}, 2, ""},
+		{"state=unknown+(host+unreachable)", []string{"compute-65"}, 1, ""},
+		{"host=kvm4*", []string{"compute-64", "compute-65"}, 2, ""},
+		{"hoststate=down", []string{"compute-65"}, 1, ""},
+		{"name=compute-*&hoststate=up", []string{"compute-64"}, 1, ""},
+		{"stale=true", []string{"compute-65"}, 1, ""},
+		{"stale=false&host=kvm4*", []string{"compute-64"}, 1, ""},
+		{"sort=-name", []string{"tam", "olh", "compute-65", "compute-64"}, 4, ""},
+		{"sort=host", []string{"olh", "tam", "compute-64", "compute-65"}, 4, ""},
+		{"sort=-last_seen", []string{"tam", "olh", "compute-64", "compute-65"}, 4, ""},
+		{"sort=state", []string{"compute-64", "tam", "olh", "compute-65"}, 4, ""},
+		{"limit=2", []string{"compute-64", "compute-65"}, 4, ""},
+		{"limit=2&offset=3", []string{"tam"}, 4, ""},
+		{"offset=9", []string{}, 4, ""},
+		{"state=bogus", nil, 0, `Bad state "bogus", expected a guest state such as running or shut off`},
+		{"hoststate=sideways", nil, 0, `Bad hoststate "sideways", expected up or down`},
+		{"sort=uuid", nil, 0, `Bad sort "uuid", expected one of: name, state, host, first_seen, last_seen`},
+		{"limit=-1", nil, 0, `Bad limit "-1", expected a number of entries`},
+		{"stale=maybe", nil, 0, `Bad stale "maybe", expected true or false`},
+		{"host=[", nil, 0, `Bad glob "[": syntax error in pattern`},
+	}
+	for _, test := range tests {
+		q, _ := url.ParseQuery(test.query)
+		got, err := listMap.listGuests(q)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, expected %q", test.query, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: listGuests() returned an error unexpectedly: %v", test.query, err)
+			continue
+		}
+		names := []string{}
+		for _, g := range got.Guests {
+			names = append(names, g.Name)
+		}
+		if !reflect.DeepEqual(names, test.names) || got.Total != test.total {
+			t.Errorf("%s: got %v of %d, expected %v of %d", test.query, names, got.Total, test.names, test.total)
+		}
+	}
+}
+
+func TestListHosts(t *testing.T) {
+	tests := []struct {
+		query string
+		names []string
+		err   string
+	}{
+		{"", []string{"kvm09.example.com", "kvm21.example.com", "kvm43.example.com", "kvm44.example.com"}, ""},
+		{"state=down", []string{"kvm21.example.com", "kvm44.example.com"}, ""},
+		{"status=up", []string{"kvm09.example.com", "kvm43.example.com"}, ""},
+		{"status=timeout&status=unreachable-dns", []string{"kvm21.example.com", "kvm44.example.com"}, ""},
+		{"name=kvm4*&stale=false", []string{"kvm43.example.com"}, ""},
+		{"sort=-guests&limit=2", []string{"kvm09.example.com", "kvm44.example.com"}, ""},
+		{"sort=last_seen", []string{"kvm21.example.com", "kvm43.example.com", "kvm09.example.com", "kvm44.example.com"}, ""},
+		{"state=sideways", nil, `Bad state "sideways", expected up or down`},
+		{"status=asleep", nil, `Bad status "asleep", expected one of: up, unreachable-dns, timeout, auth-failed, command-failed, unknown`},
+		{"sort=host", nil, `Bad sort "host", expected one of: name, state, guests, first_seen, last_seen`},
+	}
+	for _, test := range tests {
+		q, _ := url.ParseQuery(test.query)
+		got, err := listMap.listHosts(q)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, expected %q", test.query, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: listHosts() returned an error unexpectedly: %v", test.query, err)
+			continue
+		}
+		names := []string{}
+		for _, h := range got.Hosts {
+			names = append(names, h.Name)
+		}
+		if !reflect.DeepEqual(names, test.names) {
+			t.Errorf("%s: got %v, expected %v", test.query, names, test.names)
+		}
+	}
+}
+
+func TestHandleGuestList(t *testing.T) {
+	s := newServer(nil, nil)
+	s.staleAfter = 0
+	v := listMap
+	s.svmap.Replace(&v, nil)
+
+	response := httptest.NewRecorder()
+	s.handleGuestList(response, httptest.NewRequest("GET", "/api/v1/guests?state=paused&limit=10", nil))
+	var list GuestList
+	if err := json.Unmarshal(response.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	expected := GuestList{
+		Guests: []GuestEntry{{Name: "compute-64", VGuest: VGuest{State: GuestPaused, Host: "kvm43.example.com", LastSeen: &listSeen[1]}}},
+		Total:  1,
+		Limit:  10,
+	}
+	if !reflect.DeepEqual(list, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", list, expected)
+	}
+
+	response = httptest.NewRecorder()
+	s.handleHostList(response, httptest.NewRequest("GET", "/api/v1/hosts?sort=bogus", nil))
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for a bad sort, expected %d: %s", response.Code, http.StatusBadRequest, response.Body)
+	}
+}
+
+func TestDisplayGuests(t *testing.T) {
+	defer func(getter func(string) (*http.Response, error)) { HTTPGetter = getter }(HTTPGetter)
+	HTTPGetter = func(url string) (*http.Response, error) {
+		if url != "http://TESTHOST/api/v1/guests?limit=1&state=paused" {
+			t.Fatalf("ListGuests() requested the wrong URL %q", url)
+		}
+		body := `{"guests": [{"name": "compute-64", "state": "paused", "host": "kvm43.example.com"}], "total": 3, "offset": 0, "limit": 1}`
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	}
+	list, err := ListGuests("TESTHOST", url.Values{"state": {"paused"}, "limit": {"1"}})
+	if err != nil {
+		t.Fatalf("ListGuests() returned an error unexpectedly: %v", err)
+	}
+	var out bytes.Buffer
+	DisplayGuests(&out, list)
+	expected := "NAME        STATE   HOST               LAST SEEN\n" +
+		"compute-64  paused  kvm43.example.com  -\n" +
+		"Showing 1-1 of 3 guests\n"
+	if out.String() != expected {
+		t.Errorf("Got:\n%s\nExpected:\n%s", out.String(), expected)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Metadata is what virsh doesn't know about the hosts and guests, such as
+// their owners, given in the metadata file by name.  Labels are short
+// key=value pairs which nodes may be filtered by, and annotations longer
+// free text, e.g.
+//
+//	guests:
+//	  tam:
+//	    labels:
+//	      env: prod
+//	      owner: web-team
+//	    annotations:
+//	      ticket: OPS-1234
+type Metadata struct {
+	Hosts  map[string]NodeMetadata `yaml:"hosts"`
+	Guests map[string]NodeMetadata `yaml:"guests"`
+}
+
+// NodeMetadata is the metadata of one host or guest
+type NodeMetadata struct {
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// parseMetadata parses a metadata file.  Fields it doesn't know are
+// errors, so a misspelt one doesn't silently drop its labels.
+func parseMetadata(raw []byte) (*Metadata, error) {
+	m := &Metadata{}
+	if err := yaml.UnmarshalStrict(raw, m); err != nil {
+		return nil, err
+	}
+	for _, nodes := range []map[string]NodeMetadata{m.Hosts, m.Guests} {
+		for name, n := range nodes {
+			for key := range n.Labels {
+				if key == "" || strings.ContainsAny(key, "=,") {
+					return nil, fmt.Errorf("Bad label %q of %s, a key can't be empty or contain = or ,", key, name)
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// apply sets the labels and annotations of the nodes of the map to those
+// in the metadata, clearing those of nodes it doesn't name.  A node is
+// named like in a query, by its name, an alias or a short name which
+// matches no other node of its kind, and its name takes precedence.  The
+// keys which don't name a node of the map are returned, sorted.  m may
+// be nil.
+func (m *Metadata) apply(v *Vmap) []string {
+	if m == nil {
+		m = &Metadata{}
+	}
+	hostNames := make(map[string]bool, len(v.Hosts))
+	for n := range v.Hosts {
+		hostNames[n] = true
+	}
+	guestNames := make(map[string]bool, len(v.Guests))
+	for n := range v.Guests {
+		guestNames[n] = true
+	}
+	hosts, unmatched := resolveMetadata(m.Hosts, hostNames, v.Aliases)
+	guests, unmatchedGuests := resolveMetadata(m.Guests, guestNames, v.Aliases)
+	for n, h := range v.Hosts {
+		h.Labels, h.Annotations = hosts[n].Labels, hosts[n].Annotations
+		v.Hosts[n] = h
+	}
+	for n, g := range v.Guests {
+		g.Labels, g.Annotations = guests[n].Labels, guests[n].Annotations
+		v.Guests[n] = g
+	}
+	unmatched = append(unmatched, unmatchedGuests...)
+	sort.Strings(unmatched)
+	return unmatched
+}
+
+// resolveMetadata returns the metadata by the names of the nodes the keys
+// name, and the keys which don't name one
+func resolveMetadata(nodes map[string]NodeMetadata, names map[string]bool, aliases map[string]string) (map[string]NodeMetadata, []string) {
+	resolved := make(map[string]NodeMetadata, len(nodes))
+	var others, unmatched []string
+	for key, n := range nodes {
+		if names[key] {
+			resolved[key] = n
+		} else {
+			others = append(others, key)
+		}
+	}
+	sort.Strings(others)
+	for _, key := range others {
+		name, ok := resolveName(key, names, aliases)
+		if !ok {
+			unmatched = append(unmatched, key)
+			continue
+		}
+		if _, taken := resolved[name]; !taken {
+			resolved[name] = nodes[key]
+		}
+	}
+	return resolved, unmatched
+}
+
+// resolveName returns the name of the node which key names as an alias
+// or a short name, as Vmap.Get does
+func resolveName(key string, names map[string]bool, aliases map[string]string) (string, bool) {
+	if name, ok := aliases[key]; ok && names[name] {
+		return name, true
+	}
+	var matches []string
+	for name := range names {
+		if strings.HasPrefix(name, key+".") {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) != 1 {
+		return "", false
+	}
+	return matches[0], true
+}
+
+// metadataFile is the metadata file at path, which is read at every
+// reload.  The metadata last read is kept, so the map keeps its labels
+// while the file can't be read.
+type metadataFile struct {
+	sync.Mutex
+	path string
+	last *Metadata
+}
+
+// load reads the metadata file, returning the metadata last read
+// along with the error if it can't be read.  There's no metadata if
+// no file is configured.
+func (f *metadataFile) load() (*Metadata, error) {
+	if f == nil {
+		return nil, nil
+	}
+	f.Lock()
+	defer f.Unlock()
+	if f.path == "" {
+		return nil, nil
+	}
+	raw, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return f.last, err
+	}
+	m, err := parseMetadata(raw)
+	if err != nil {
+		return f.last, fmt.Errorf("%s: %v", f.path, err)
+	}
+	f.last = m
+	return m, nil
+}
+
+// current returns the metadata last read
+func (f *metadataFile) current() *Metadata {
+	if f == nil {
+		return nil
+	}
+	f.Lock()
+	defer f.Unlock()
+	return f.last
+}
+
+// labelFilter returns a function which tells whether a node's labels
+// match all of the label parameters in q, each of which is key=value or
+// just key, which a node matches if it has the label at all
+func labelFilter(q url.Values) (func(labels map[string]string) bool, error) {
+	type selector struct {
+		key, value string
+		any        bool
+	}
+	var selectors []selector
+	for _, s := range q["label"] {
+		i := strings.Index(s, "=")
+		sel := selector{key: s, any: true}
+		if i >= 0 {
+			sel = selector{key: s[:i], value: s[i+1:]}
+		}
+		if sel.key == "" {
+			return nil, fmt.Errorf("Bad label %q, expected key=value or key", s)
+		}
+		selectors = append(selectors, sel)
+	}
+	return func(labels map[string]string) bool {
+		for _, sel := range selectors {
+			value, ok := labels[sel.key]
+			if !ok || (!sel.any && value != sel.value) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// LabelsLine describes the labels of a node for the query command,
+// or returns an empty string if it has none
+func LabelsLine(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return "  labels: " + strings.Join(pairs, ", ")
+}
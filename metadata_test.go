@@ -0,0 +1,257 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var metadataYAML = []byte(`hosts:
+  kvm09.example.com:
+    labels:
+      rack: r12
+guests:
+  tam:
+    labels:
+      env: prod
+      owner: web-team
+    annotations:
+      ticket: OPS-1234
+  olh:
+    labels:
+      env: staging
+`)
+
+func TestParseMetadata(t *testing.T) {
+	got, err := parseMetadata(metadataYAML)
+	if err != nil {
+		t.Fatalf("parseMetadata() returned an error unexpectedly: %v", err)
+	}
+	expected := &Metadata{
+		Hosts: map[string]NodeMetadata{
+			"kvm09.example.com": {Labels: map[string]string{"rack": "r12"}},
+		},
+		Guests: map[string]NodeMetadata{
+			"tam": {
+				Labels:      map[string]string{"env": "prod", "owner": "web-team"},
+				Annotations: map[string]string{"ticket": "OPS-1234"},
+			},
+			"olh": {Labels: map[string]string{"env": "staging"}},
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", got, expected)
+	}
+
+	tests := []struct {
+		raw string
+		err string
+	}{
+		{"guests:\n  tam:\n    lables:\n      env: prod\n", "yaml: unmarshal errors:\n  line 3: field lables not found in type main.NodeMetadata"},
+		{"guests:\n  tam:\n    labels:\n      a=b: prod\n", `Bad label "a=b" of tam, a key can't be empty or contain = or ,`},
+		{"hosts:\n  kvm09:\n    labels:\n      \"\": r12\n", `Bad label "" of kvm09, a key can't be empty or contain = or ,`},
+	}
+	for _, test := range tests {
+		if _, err := parseMetadata([]byte(test.raw)); err == nil || err.Error() != test.err {
+			t.Errorf("Got error %v, expected %q", err, test.err)
+		}
+	}
+}
+
+func TestMetadataApply(t *testing.T) {
+	m, err := parseMetadata(metadataYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": {State: "up", Guests: []string{"tam"}},
+			"kvm43.example.com": {State: "up", Guests: []string{"compute-64"}, Labels: map[string]string{"rack": "r1"}},
+		},
+		Guests: map[string]VGuest{
+			"tam":        {State: GuestRunning, Host: "kvm09.example.com"},
+			"compute-64": {State: GuestPaused, Host: "kvm43.example.com"},
+		},
+	}
+	m.apply(&v)
+	expected := Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": {State: "up", Guests: []string{"tam"}, Labels: map[string]string{"rack": "r12"}},
+			"kvm43.example.com": {State: "up", Guests: []string{"compute-64"}},
+		},
+		Guests: map[string]VGuest{
+			"tam": {
+				State:       GuestRunning,
+				Host:        "kvm09.example.com",
+				Labels:      map[string]string{"env": "prod", "owner": "web-team"},
+				Annotations: map[string]string{"ticket": "OPS-1234"},
+			},
+			"compute-64": {State: GuestPaused, Host: "kvm43.example.com"},
+		},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", v, expected)
+	}
+
+	// No metadata clears the labels
+	(*Metadata)(nil).apply(&v)
+	if v.Guests["tam"].Labels != nil || v.Hosts["kvm09.example.com"].Labels != nil {
+		t.Errorf("Labels weren't cleared: %#v", v)
+	}
+}
+
+func TestMetadataApplyNames(t *testing.T) {
+	m, err := parseMetadata([]byte(`hosts:
+  kvm09:
+    labels:
+      rack: r12
+  db:
+    labels:
+      rack: r1
+  kvm99:
+    labels:
+      rack: r9
+guests:
+  tam:
+    labels:
+      env: prod
+  web:
+    labels:
+      env: staging
+  web.example.com:
+    labels:
+      env: prod
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": {State: "up"},
+			"kvm43.example.com": {State: "up"},
+		},
+		Guests: map[string]VGuest{
+			"tam.example.com": {State: GuestRunning, Host: "kvm09.example.com"},
+			"web.example.com": {State: GuestRunning, Host: "kvm43.example.com"},
+		},
+		Aliases: map[string]string{"db": "kvm43.example.com"},
+	}
+	unmatched := m.apply(&v)
+	// A short name and an alias name their node, and a name takes precedence over them
+	labels := map[string]string{
+		"kvm09.example.com": v.Hosts["kvm09.example.com"].Labels["rack"],
+		"kvm43.example.com": v.Hosts["kvm43.example.com"].Labels["rack"],
+		"tam.example.com":   v.Guests["tam.example.com"].Labels["env"],
+		"web.example.com":   v.Guests["web.example.com"].Labels["env"],
+	}
+	expected := map[string]string{
+		"kvm09.example.com": "r12",
+		"kvm43.example.com": "r1",
+		"tam.example.com":   "prod",
+		"web.example.com":   "prod",
+	}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", labels, expected)
+	}
+	if expected := []string{"kvm99"}; !reflect.DeepEqual(unmatched, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", unmatched, expected)
+	}
+}
+
+func TestLabelFilter(t *testing.T) {
+	labels := map[string]string{"env": "prod", "owner": "web-team", "empty": ""}
+	tests := []struct {
+		query string
+		match bool
+		err   string
+	}{
+		{"", true, ""},
+		{"label=env=prod", true, ""},
+		{"label=env=staging", false, ""},
+		{"label=env", true, ""},
+		{"label=rack", false, ""},
+		{"label=empty=", true, ""},
+		{"label=env=prod&label=owner=web-team", true, ""},
+		{"label=env=prod&label=owner=db-team", false, ""},
+		{"label==prod", false, `Bad label "=prod", expected key=value or key`},
+	}
+	for _, test := range tests {
+		q, _ := url.ParseQuery(test.query)
+		match, err := labelFilter(q)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, expected %q", test.query, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: labelFilter() returned an error unexpectedly: %v", test.query, err)
+			continue
+		}
+		if got := match(labels); got != test.match {
+			t.Errorf("%s: got %v, expected %v", test.query, got, test.match)
+		}
+	}
+}
+
+func TestReloadMetadata(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "virtmapper.txt")
+	if err := ioutil.WriteFile(file, ansibleOutput, 0644); err != nil {
+		t.Fatal(err)
+	}
+	metadata := filepath.Join(dir, "metadata.yaml")
+	if err := ioutil.WriteFile(metadata, metadataYAML, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := NewSources([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(sources, nil)
+	s.metadata.path = metadata
+
+	if status := s.reload("test"); status.Error != "" {
+		t.Fatalf("reload() returned an error unexpectedly: %s", status.Error)
+	}
+	q, _ := url.ParseQuery("label=env=prod")
+	list, err := s.svmap.Vmap.listGuests(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Guests) != 1 || list.Guests[0].Name != "tam" || list.Guests[0].Annotations["ticket"] != "OPS-1234" {
+		t.Errorf("Incorrect guests labelled env=prod: %#v", list.Guests)
+	}
+
+	// A broken metadata file keeps the labels last loaded
+	if err := ioutil.WriteFile(metadata, []byte("guests: ["), 0644); err != nil {
+		t.Fatal(err)
+	}
+	status := s.reload("test")
+	expected := "Problem loading metadata: " + metadata + ": yaml: line 1: did not find expected node content"
+	if status.Error != expected {
+		t.Errorf("Got error %q, expected %q", status.Error, expected)
+	}
+	if got := s.svmap.Vmap.Hosts["kvm09.example.com"].Labels["rack"]; got != "r12" {
+		t.Errorf("Got rack %q for kvm09, expected the previous r12", got)
+	}
+}
+
+func TestLabelsLine(t *testing.T) {
+	if got := LabelsLine(nil); got != "" {
+		t.Errorf("Got %q for no labels, expected nothing", got)
+	}
+	got := LabelsLine(map[string]string{"owner": "web-team", "env": "prod"})
+	if expected := "  labels: env=prod, owner=web-team"; got != expected {
+		t.Errorf("Got:\n%s\nExpected:\n%s", got, expected)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Migration is a guest found on a different host than before
+type Migration struct {
+	Guest      string    `json:"guest"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// MigrationCount is the number of migrations into and out of a host
+type MigrationCount struct {
+	In  int `json:"in"`
+	Out int `json:"out"`
+}
+
+// diffMigrations returns the guests of next which are on a different
+// host than in prev, as migrations detected at the given time.  A guest
+// which is still defined on its host in prev hasn't migrated, even if
+// it is now also defined elsewhere.
+func diffMigrations(prev, next *Vmap, at time.Time) []Migration {
+	var migrations []Migration
+	for name, g := range next.Guests {
+		old, ok := prev.Guests[name]
+		if !ok || old.Host == g.Host || old.Host == "" || g.Host == "" {
+			continue
+		}
+		if _, still := g.placementOn(old.Host); still {
+			continue
+		}
+		migrations = append(migrations, Migration{Guest: name, From: old.Host, To: g.Host, DetectedAt: at})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Guest < migrations[j].Guest })
+	return migrations
+}
+
+// migrationLog keeps the latest migrations, at most size of them, and
+// counts all of the migrations into and out of each host
+type migrationLog struct {
+	sync.Mutex
+	size       int
+	migrations []Migration
+	total      int
+	counts     map[string]MigrationCount
+}
+
+func newMigrationLog(size int) *migrationLog {
+	return &migrationLog{size: size, counts: make(map[string]MigrationCount)}
+}
+
+// add adds migrations to the log, dropping the oldest beyond its size
+func (l *migrationLog) add(migrations []Migration) {
+	l.Lock()
+	defer l.Unlock()
+	for _, m := range migrations {
+		from, to := l.counts[m.From], l.counts[m.To]
+		from.Out++
+		to.In++
+		l.counts[m.From], l.counts[m.To] = from, to
+	}
+	l.total += len(migrations)
+	l.migrations = append(l.migrations, migrations...)
+	if over := len(l.migrations) - l.size; over > 0 {
+		l.migrations = append([]Migration(nil), l.migrations[over:]...)
+	}
+}
+
+// MigrationReport is the response of the migrations endpoint
+type MigrationReport struct {
+	Migrations []Migration               `json:"migrations"`
+	Hosts      map[string]MigrationCount `json:"hosts"`
+	Total      int                       `json:"total"`
+}
+
+// report returns the migrations in the log, oldest first, which are of
+// guest and from or to host if they are given, with the counts of all
+// of the migrations since the server started
+func (l *migrationLog) report(guest, host string) MigrationReport {
+	l.Lock()
+	defer l.Unlock()
+	r := MigrationReport{
+		Migrations: []Migration{},
+		Hosts:      make(map[string]MigrationCount, len(l.counts)),
+		Total:      l.total,
+	}
+	for _, m := range l.migrations {
+		if (guest == "" || m.Guest == guest) && (host == "" || m.From == host || m.To == host) {
+			r.Migrations = append(r.Migrations, m)
+		}
+	}
+	for h, c := range l.counts {
+		r.Hosts[h] = c
+	}
+	return r
+}
+
+// writeMigrationMetrics writes the migration counts
+// in the Prometheus text format
+func writeMigrationMetrics(w io.Writer, r MigrationReport) {
+	fmt.Fprintf(w, "# HELP virtmapper_migrations_total Migrations of guests detected.\n# TYPE virtmapper_migrations_total counter\nvirtmapper_migrations_total %d\n", r.Total)
+	fmt.Fprintf(w, "# HELP virtmapper_host_migrations_total Migrations of guests into and out of each host.\n# TYPE virtmapper_host_migrations_total counter\n")
+	hosts := make([]string, 0, len(r.Hosts))
+	for h := range r.Hosts {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	for _, h := range hosts {
+		fmt.Fprintf(w, "virtmapper_host_migrations_total{host=%q,direction=\"in\"} %d\n", h, r.Hosts[h].In)
+		fmt.Fprintf(w, "virtmapper_host_migrations_total{host=%q,direction=\"out\"} %d\n", h, r.Hosts[h].Out)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffMigrations(t *testing.T) {
+	at := time.Date(2026, 9, 1, 11, 0, 0, 0, time.UTC)
+	got := diffMigrations(historyMaps[0], historyMaps[1], at)
+	expected := []Migration{{Guest: "tam", From: "kvm09.example.com", To: "kvm43.example.com", DetectedAt: at}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", got, expected)
+	}
+	// Guests which appear, disappear or change state haven't migrated
+	for i := 1; i < len(historyMaps)-1; i++ {
+		if got := diffMigrations(historyMaps[i], historyMaps[i+1], at); len(got) != 0 {
+			t.Errorf("Got migrations %#v between maps %d and %d, expected none", got, i, i+1)
+		}
+	}
+	// A guest which is also defined on another host hasn't migrated
+	copied := &Vmap{Guests: map[string]VGuest{
+		"tam": {State: GuestRunning, Host: "kvm43.example.com", Placements: []Placement{
+			{Host: "kvm43.example.com", State: GuestRunning},
+			{Host: "kvm09.example.com", State: GuestShutOff},
+		}},
+		"olh": {State: GuestShutOff, Host: "kvm09.example.com"},
+	}}
+	if got := diffMigrations(historyMaps[0], copied, at); len(got) != 0 {
+		t.Errorf("Got migrations %#v of a guest defined on another host, expected none", got)
+	}
+}
+
+func TestMigrationLog(t *testing.T) {
+	l := newMigrationLog(2)
+	at := time.Date(2026, 9, 1, 11, 0, 0, 0, time.UTC)
+	l.add([]Migration{
+		{Guest: "tam", From: "kvm09.example.com", To: "kvm43.example.com", DetectedAt: at},
+		{Guest: "olh", From: "kvm09.example.com", To: "kvm43.example.com", DetectedAt: at},
+	})
+	l.add([]Migration{{Guest: "tam", From: "kvm43.example.com", To: "kvm59.example.com", DetectedAt: at.Add(time.Hour)}})
+
+	expected := MigrationReport{
+		Migrations: []Migration{
+			{Guest: "olh", From: "kvm09.example.com", To: "kvm43.example.com", DetectedAt: at},
+			{Guest: "tam", From: "kvm43.example.com", To: "kvm59.example.com", DetectedAt: at.Add(time.Hour)},
+		},
+		Hosts: map[string]MigrationCount{
+			"kvm09.example.com": {Out: 2},
+			"kvm43.example.com": {In: 2, Out: 1},
+			"kvm59.example.com": {In: 1},
+		},
+		Total: 3,
+	}
+	if got := l.report("", ""); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", got, expected)
+	}
+	if got := l.report("tam", ""); len(got.Migrations) != 1 || got.Migrations[0].To != "kvm59.example.com" {
+		t.Errorf("Got migrations of tam %#v", got.Migrations)
+	}
+	if got := l.report("", "kvm09.example.com"); len(got.Migrations) != 1 || got.Migrations[0].Guest != "olh" {
+		t.Errorf("Got migrations of kvm09.example.com %#v", got.Migrations)
+	}
+}
+
+func TestHandleMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "virtmapper.txt")
+	if err := ioutil.WriteFile(file, ansibleOutput, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := NewSources([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(sources, nil)
+	s.reload("startup")
+	// tam has been migrated to kvm43
+	migrated := strings.Replace(string(ansibleOutput), " 4     tam                            running\n", "", 1)
+	migrated = strings.Replace(migrated, " 99    compute-64                     paused\n", " 99    compute-64                     paused\n 7     tam                            running\n", 1)
+	if err := ioutil.WriteFile(file, []byte(migrated), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.reload("test")
+
+	response := httptest.NewRecorder()
+	s.handleMigrations(response, httptest.NewRequest("GET", MigrationsPath, nil))
+	var report MigrationReport
+	if err := json.Unmarshal(response.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Migrations) != 1 || report.Migrations[0].Guest != "tam" || report.Migrations[0].From != "kvm09.example.com" ||
+		report.Migrations[0].To != "kvm43.example.com" || report.Hosts["kvm43.example.com"].In != 1 {
+		t.Errorf("Incorrect migrations: %s", response.Body.String())
+	}
+
+	response = httptest.NewRecorder()
+	s.handleMetrics(response, httptest.NewRequest("GET", MetricsPath, nil))
+	for _, line := range []string{
+		"virtmapper_migrations_total 1",
+		`virtmapper_host_migrations_total{host="kvm43.example.com",direction="in"} 1`,
+		`virtmapper_host_migrations_total{host="kvm09.example.com",direction="out"} 1`,
+	} {
+		if !strings.Contains(response.Body.String(), line+"\n") {
+			t.Errorf("The metrics have no %q:\n%s", line, response.Body.String())
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// reloadGuard holds the sanity checks a reload must pass to replace the
+// map, so a truncated or stale Ansible output file can't empty it.  Zero
+// values disable the checks.
+//
+// maxShrink is the largest percentage of the guests a reload may drop,
+// and minHosts the fewest hosts it may have.  Every file source must
+// contain all of the markers, and the file and tree sources must have
+// been written within maxAge.
+type reloadGuard struct {
+	maxShrink float64
+	minHosts  int
+	markers   []string
+	maxAge    time.Duration
+}
+
+// checkSources checks the ages of the files of the sources before they
+// are loaded.  Their markers are checked as they load, see markSources.
+func (g *reloadGuard) checkSources(sources []Source) error {
+	if g.maxAge <= 0 {
+		return nil
+	}
+	for _, src := range sources {
+		ws, ok := src.(watchedSource)
+		if !ok {
+			continue
+		}
+		path := ws.WatchPath()
+		modified, err := lastModified(path)
+		if err != nil {
+			return err
+		}
+		if age := time.Since(modified); age > g.maxAge {
+			return fmt.Errorf("%s was last written %v ago, more than %v", path, age.Round(time.Second), g.maxAge)
+		}
+	}
+	return nil
+}
+
+// markSources returns the sources with each file source checked for the
+// markers in the same read which loads it, so the file checked is the
+// one loaded and it is only streamed once.  The load of a file without
+// all of the markers fails, and incomplete returns its error once the
+// sources have loaded.
+func (g *reloadGuard) markSources(sources []Source) (marked []Source, incomplete func() error) {
+	var err error
+	marked = make([]Source, len(sources))
+	for i, src := range sources {
+		marked[i] = src
+		if f, ok := src.(*fileSource); ok && len(g.markers) > 0 {
+			marked[i] = &markedSource{fileSource: f, markers: g.markers, err: &err}
+		}
+	}
+	return marked, func() error { return err }
+}
+
+// markedSource is a file source which is checked for the markers
+type markedSource struct {
+	*fileSource
+	markers []string
+	err     *error
+}
+
+func (m *markedSource) Fetch() (io.ReadCloser, error) {
+	rc, err := m.fileSource.Fetch()
+	if err != nil {
+		return nil, err
+	}
+	return &markerReader{
+		ReadCloser: rc,
+		path:       m.path,
+		markers:    m.markers,
+		found:      make([]bool, len(m.markers)),
+		err:        m.err,
+	}, nil
+}
+
+// markerReader looks for the markers in the data as it is read.  At the
+// end of the data a missing marker is an error, which is also recorded
+// in err.  Data the parser didn't read is read when the reader is closed.
+type markerReader struct {
+	io.ReadCloser
+	path    string
+	markers []string
+	found   []bool
+	tail    []byte
+	eof     bool
+	err     *error
+}
+
+func (m *markerReader) Read(p []byte) (int, error) {
+	n, err := m.ReadCloser.Read(p)
+	m.scan(p[:n])
+	if err == io.EOF && !m.eof {
+		m.eof = true
+		if missing := m.missing(); missing != nil {
+			if *m.err == nil {
+				*m.err = missing
+			}
+			return n, missing
+		}
+	}
+	return n, err
+}
+
+func (m *markerReader) Close() error {
+	if !m.eof {
+		io.Copy(ioutil.Discard, m)
+	}
+	return m.ReadCloser.Close()
+}
+
+// scan looks for the markers in the data read, along with the end of the
+// data read before it in case a marker spans two reads
+func (m *markerReader) scan(data []byte) {
+	keep := 0
+	window := append(m.tail, data...)
+	for i, marker := range m.markers {
+		if !m.found[i] && bytes.Contains(window, []byte(marker)) {
+			m.found[i] = true
+		}
+		if len(marker)-1 > keep {
+			keep = len(marker) - 1
+		}
+	}
+	if len(window) > keep {
+		window = window[len(window)-keep:]
+	}
+	m.tail = append(m.tail[:0], window...)
+}
+
+// missing returns the error for the first marker which wasn't found
+func (m *markerReader) missing() error {
+	for i, marker := range m.markers {
+		if !m.found[i] {
+			return fmt.Errorf("%s is incomplete, it has no %q", m.path, marker)
+		}
+	}
+	return nil
+}
+
+// checkMap checks the reloaded map v against the current map prev
+func (g *reloadGuard) checkMap(prev, v *Vmap) error {
+	if len(v.Hosts) < g.minHosts {
+		return fmt.Errorf("%d hosts, fewer than %d", len(v.Hosts), g.minHosts)
+	}
+	if g.maxShrink > 0 && len(prev.Guests) > 0 {
+		shrink := 100 * float64(len(prev.Guests)-len(v.Guests)) / float64(len(prev.Guests))
+		if shrink > g.maxShrink {
+			return fmt.Errorf("%d guests, down from %d by %.0f%%, more than %g%%", len(v.Guests), len(prev.Guests), shrink, g.maxShrink)
+		}
+	}
+	return nil
+}
+
+// lastModified returns the modification time of a file, or of
+// the newest of a directory and the files in it
+func lastModified(path string) (time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	modified := fi.ModTime()
+	if fi.IsDir() {
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, f := range files {
+			if f.ModTime().After(modified) {
+				modified = f.ModTime()
+			}
+		}
+	}
+	return modified, nil
+}
+
+// ReloadStatus is the outcome of a reload.  Rejected is the reason a
+// reload which failed a sanity check was rejected, in which case the
+// previous map was kept.  Error describes any sources which failed to
+// load, whose nodes were kept from the previous map.
+type ReloadStatus struct {
+	Time     time.Time `json:"time"`
+	Cause    string    `json:"cause"`
+	Accepted bool      `json:"accepted"`
+	Rejected string    `json:"rejected,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Hosts    int       `json:"hosts"`
+	Guests   int       `json:"guests"`
+}
+
+// reloadStats records the reloads for the reload endpoint and the metrics
+type reloadStats struct {
+	sync.Mutex
+	last         *ReloadStatus
+	lastRejected *ReloadStatus
+	total        int
+	rejected     int
+}
+
+func (r *reloadStats) add(status ReloadStatus) {
+	r.Lock()
+	defer r.Unlock()
+	r.total++
+	r.last = &status
+	if !status.Accepted {
+		r.rejected++
+		r.lastRejected = &status
+	}
+}
+
+// ReloadReport is the response of the reload endpoint
+type ReloadReport struct {
+	Last         *ReloadStatus `json:"last"`
+	LastRejected *ReloadStatus `json:"last_rejected,omitempty"`
+	Reloads      int           `json:"reloads"`
+	Rejected     int           `json:"rejected"`
+}
+
+func (r *reloadStats) report() ReloadReport {
+	r.Lock()
+	defer r.Unlock()
+	return ReloadReport{Last: r.last, LastRejected: r.lastRejected, Reloads: r.total, Rejected: r.rejected}
+}
+
+// writeMetrics writes the metrics in the Prometheus text format
+func writeMetrics(w io.Writer, r ReloadReport, hosts, guests int) {
+	metric := func(name, kind, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	lastRejected, lastReload := 0.0, 0.0
+	if r.Last != nil {
+		if !r.Last.Accepted {
+			lastRejected = 1
+		}
+		lastReload = float64(r.Last.Time.Unix())
+	}
+	metric("virtmapper_reloads_total", "counter", "Reloads of the map.", float64(r.Reloads))
+	metric("virtmapper_reloads_rejected_total", "counter", "Reloads rejected by the sanity checks.", float64(r.Rejected))
+	metric("virtmapper_last_reload_rejected", "gauge", "Whether the last reload was rejected.", lastRejected)
+	metric("virtmapper_last_reload_timestamp_seconds", "gauge", "Time of the last reload.", lastReload)
+	metric("virtmapper_hosts", "gauge", "Hosts in the map.", float64(hosts))
+	metric("virtmapper_guests", "gauge", "Guests in the map.", float64(guests))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestReloadGuardCheckMap(t *testing.T) {
+	prev, err := ParseAnsibleOutput(ansibleOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One of the three guests is gone
+	shrunk, err := ParseAnsibleOutput(ansibleOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(shrunk.Guests, "olh")
+
+	tests := []struct {
+		name  string
+		guard reloadGuard
+		prev  *Vmap
+		err   string
+	}{
+		{"disabled", reloadGuard{}, prev, ""},
+		{"shrink allowed", reloadGuard{maxShrink: 50}, prev, ""},
+		{"shrink too far", reloadGuard{maxShrink: 25}, prev, "2 guests, down from 3 by 33%, more than 25%"},
+		{"first load", reloadGuard{maxShrink: 25}, &Vmap{}, ""},
+		{"enough hosts", reloadGuard{minHosts: 5}, prev, ""},
+		{"too few hosts", reloadGuard{minHosts: 6}, prev, "5 hosts, fewer than 6"},
+	}
+	for _, test := range tests {
+		err := test.guard.checkMap(test.prev, shrunk)
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestReloadGuardCheckSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "virtmapper.txt")
+	if err := ioutil.WriteFile(file, []byte(string(ansibleOutput)+"# virtmapper: done\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := filepath.Join(dir, "old.txt")
+	if err := ioutil.WriteFile(old, ansibleOutput, 0644); err != nil {
+		t.Fatal(err)
+	}
+	yesterday := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(old, yesterday, yesterday); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := NewSources([]string{file, "tree:" + dir, "http://ansible.example.com/dc2.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSources, err := NewSources([]string{old})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		guard   reloadGuard
+		sources []Source
+		err     string
+	}{
+		{"disabled", reloadGuard{}, oldSources, ""},
+		{"fresh", reloadGuard{maxAge: time.Hour}, sources, ""},
+		{"stale", reloadGuard{maxAge: time.Hour}, oldSources, old + " was last written 24h0m0s ago, more than 1h0m0s"},
+	}
+	for _, test := range tests {
+		err := test.guard.checkSources(test.sources)
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestReloadGuardMarkSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "virtmapper.txt")
+	if err := ioutil.WriteFile(file, []byte(string(ansibleOutput)+"# virtmapper: done\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := filepath.Join(dir, "old.txt")
+	if err := ioutil.WriteFile(old, ansibleOutput, 0644); err != nil {
+		t.Fatal(err)
+	}
+	guard := reloadGuard{markers: []string{"# virtmapper: done"}}
+
+	tests := []struct {
+		name string
+		path string
+		err  string
+	}{
+		{"marker", file, ""},
+		{"no marker", old, old + ` is incomplete, it has no "# virtmapper: done"`},
+	}
+	for _, test := range tests {
+		sources, err := NewSources([]string{test.path, "tree:" + dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		marked, incomplete := guard.markSources(sources)
+		if marked[1] != sources[1] {
+			t.Errorf("%s: the tree source was checked for markers", test.name)
+		}
+		_, _, loadErr := LoadSources(marked, nil)
+		err = incomplete()
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+		}
+		if test.err != "" && (loadErr == nil || !strings.Contains(loadErr.Error(), test.err)) {
+			t.Errorf("%s: got load error %v, expected the load to fail", test.name, loadErr)
+		}
+	}
+}
+
+func TestMarkerReader(t *testing.T) {
+	data := "kvm09.example.com | success | rc=0 >>\n# virtmapper: done\n"
+	tests := []struct {
+		name    string
+		markers []string
+		read    bool
+		err     string
+	}{
+		{"read", []string{"# virtmapper: done", "rc=0"}, true, ""},
+		{"read missing", []string{"rc=0", "stats"}, true, `test.txt is incomplete, it has no "stats"`},
+		{"closed early", []string{"# virtmapper: done"}, false, ""},
+		{"closed early missing", []string{"stats"}, false, `test.txt is incomplete, it has no "stats"`},
+	}
+	for _, test := range tests {
+		var err error
+		// Read a byte at a time, so every marker spans several reads
+		r := &markerReader{
+			ReadCloser: ioutil.NopCloser(iotest.OneByteReader(strings.NewReader(data))),
+			path:       "test.txt",
+			markers:    test.markers,
+			found:      make([]bool, len(test.markers)),
+			err:        &err,
+		}
+		if test.read {
+			if _, readErr := ioutil.ReadAll(r); (readErr == nil) != (test.err == "") {
+				t.Errorf("%s: got read error %v, expected %q", test.name, readErr, test.err)
+			}
+		}
+		r.Close()
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestReloadRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "virtmapper.txt")
+	if err := ioutil.WriteFile(file, ansibleOutput, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := NewSources([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(sources, nil)
+	s.guard = reloadGuard{maxShrink: 25}
+	if status := s.reload("startup"); !status.Accepted || status.Guests != 3 {
+		t.Fatalf("The first reload wasn't accepted: %#v", status)
+	}
+
+	// Ansible has only written the first host so far
+	truncated := ansibleOutput[:strings.Index(string(ansibleOutput), "kvm43")]
+	if err := ioutil.WriteFile(file, truncated, 0644); err != nil {
+		t.Fatal(err)
+	}
+	status := s.reload("test")
+	if status.Accepted || status.Rejected != "2 guests, down from 3 by 33%, more than 25%" || status.Guests != 3 {
+		t.Errorf("The truncated reload wasn't rejected: %#v", status)
+	}
+	if _, err := s.svmap.Get("compute-64"); err != nil {
+		t.Errorf("The previous map wasn't kept: %v", err)
+	}
+
+	response := httptest.NewRecorder()
+	s.handleReload(response, httptest.NewRequest("GET", ReloadPath, nil))
+	var report ReloadReport
+	if err := json.Unmarshal(response.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Reloads != 2 || report.Rejected != 1 || report.Last == nil || report.Last.Cause != "test" || report.LastRejected == nil {
+		t.Errorf("Incorrect reload report: %#v", report)
+	}
+
+	response = httptest.NewRecorder()
+	s.handleMetrics(response, httptest.NewRequest("GET", MetricsPath, nil))
+	for _, line := range []string{
+		"virtmapper_reloads_total 2",
+		"virtmapper_reloads_rejected_total 1",
+		"virtmapper_last_reload_rejected 1",
+		"virtmapper_guests 3",
+	} {
+		if !strings.Contains(response.Body.String(), line+"\n") {
+			t.Errorf("The metrics have no %q:\n%s", line, response.Body.String())
+		}
+	}
+
+	// A file without the marker is rejected as it is loaded
+	s.guard = reloadGuard{markers: []string{"# virtmapper: done"}}
+	status = s.reload("test")
+	if expected := file + ` is incomplete, it has no "# virtmapper: done"`; status.Accepted || status.Rejected != expected || status.Guests != 3 {
+		t.Errorf("The incomplete reload wasn't rejected: %#v", status)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxReportSize is the largest report a host may push
+const maxReportSize = 16 * 1024 * 1024
+
+// reportSource holds the latest report pushed by each host to the report
+// endpoint, so that the reports are part of the map after every reload.
+// It is the first of the server's sources, so a host's own report takes
+// precedence over what other sources say about it, until the report
+// expires.
+type reportSource struct {
+	sync.Mutex
+	hosts map[string]libvirtHost
+}
+
+func newReportSource() *reportSource {
+	return &reportSource{hosts: make(map[string]libvirtHost)}
+}
+
+func (r *reportSource) Name() string {
+	return "report"
+}
+
+// add records the report of a host, returning the map of just that host
+func (r *reportSource) add(h libvirtHost) (*Vmap, []Diagnostic) {
+	r.Lock()
+	r.hosts[h.Name] = h
+	r.Unlock()
+	v, diags := parseLibvirtHosts([]libvirtHost{h})
+	v.setSource(r.Name())
+	for i := range diags {
+		diags[i].Source = r.Name()
+	}
+	return v, diags
+}
+
+// expire drops the reports made before the time, returning the names of
+// their hosts, sorted
+func (r *reportSource) expire(before time.Time) []string {
+	r.Lock()
+	defer r.Unlock()
+	var expired []string
+	for name, h := range r.hosts {
+		if h.Reported != nil && h.Reported.Before(before) {
+			delete(r.hosts, name)
+			expired = append(expired, name)
+		}
+	}
+	sort.Strings(expired)
+	return expired
+}
+
+// Fetch returns the reports as a JSON list of hosts, sorted by name
+func (r *reportSource) Fetch() (io.ReadCloser, error) {
+	r.Lock()
+	hosts := make([]libvirtHost, 0, len(r.hosts))
+	for _, h := range r.hosts {
+		hosts = append(hosts, h)
+	}
+	r.Unlock()
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	raw, err := json.Marshal(hosts)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(raw)), nil
+}
+
+func (r *reportSource) Parse(rd io.Reader) (*Vmap, []Diagnostic, error) {
+	var hosts []libvirtHost
+	if err := json.NewDecoder(rd).Decode(&hosts); err != nil {
+		return nil, nil, err
+	}
+	v, diags := parseLibvirtHosts(hosts)
+	return v, diags, nil
+}
+
+// parseReport parses the report of a host, which is either the output of
+// "virsh list --all" or, with a JSON content type, a JSON object with the
+// host's domains like that of a libvirt source.  The host is named by the
+// caller rather than the report.
+func parseReport(host string, contentType string, body []byte) (libvirtHost, error) {
+	h := libvirtHost{Name: host}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/json" {
+		if err := json.Unmarshal(body, &h); err != nil {
+			return h, fmt.Errorf("Bad report: %v", err)
+		}
+		h.Name, h.Reported = host, nil
+		for _, d := range h.Domains {
+			if strings.TrimSpace(d.Name) == "" {
+				return h, fmt.Errorf("Bad report: a domain has no name")
+			}
+		}
+		return h, nil
+	}
+	lines := strings.Split(string(body), "\n")
+	domains, unrecognized := parseVirshList(string(body))
+	if len(unrecognized) > 0 {
+		return h, fmt.Errorf("Bad report: unrecognized line in the virsh output: %q", lines[unrecognized[0]])
+	}
+	for _, d := range domains {
+		h.Domains = append(h.Domains, libvirtDomain{Name: d.Name, State: d.State})
+	}
+	return h, nil
+}
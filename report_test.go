@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseReport(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		host        libvirtHost
+		error       string
+	}{
+		{
+			"virsh",
+			"text/plain",
+			" Id    Name                           State\n----------------------------------------------------\n 4     tam                            running\n -     olh                            shut off\n",
+			libvirtHost{Name: "kvm09.example.com", Domains: []libvirtDomain{{Name: "tam", State: GuestRunning}, {Name: "olh", State: GuestShutOff}}},
+			"",
+		},
+		{
+			"json",
+			"application/json; charset=utf-8",
+			`{"name": "other", "domains": [{"name": "tam", "uuid": "6f8e2a61-1b4c-4a3e-9d1f-0e6a5b2c7d90", "state": "running", "vcpus": 2, "memory_kib": 2097152}]}`,
+			libvirtHost{Name: "kvm09.example.com", Domains: []libvirtDomain{{Name: "tam", UUID: "6f8e2a61-1b4c-4a3e-9d1f-0e6a5b2c7d90", State: GuestRunning, VCPUs: 2, MemoryKiB: 2097152}}},
+			"",
+		},
+		{
+			"json failure",
+			"application/json",
+			`{"status": "command-failed", "error": "error: failed to connect to the hypervisor"}`,
+			libvirtHost{Name: "kvm09.example.com", Status: HostCommandFailed, Error: "error: failed to connect to the hypervisor"},
+			"",
+		},
+		{"virsh error", "", "error: failed to connect to the hypervisor\n", libvirtHost{}, `Bad report: unrecognized line in the virsh output: "error: failed to connect to the hypervisor"`},
+		{"bad json", "application/json", `{"domains": [`, libvirtHost{}, "Bad report: unexpected end of JSON input"},
+		{"unnamed", "application/json", `{"domains": [{"state": "running"}]}`, libvirtHost{}, "Bad report: a domain has no name"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, err := parseReport("kvm09.example.com", test.contentType, []byte(test.body))
+			if test.error != "" {
+				if err == nil || err.Error() != test.error {
+					t.Fatalf("parseReport() returned the wrong error\nGot:\n%v\nExpected:\n%v", err, test.error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseReport() returned an error unexpectedly: %v", err)
+			}
+			if !reflect.DeepEqual(h, test.host) {
+				t.Fatalf("parseReport() failed.\nGot:\n%#v\nExpected:\n%#v", h, test.host)
+			}
+		})
+	}
+}
+
+func TestReportSource(t *testing.T) {
+	r := newReportSource()
+	r.add(libvirtHost{Name: "kvm09.example.com", Domains: []libvirtDomain{{Name: "tam", State: GuestRunning}}})
+	r.add(libvirtHost{Name: "kvm10.example.com", Status: HostCommandFailed, Error: "error: failed to connect to the hypervisor"})
+	vmap, diags, err := LoadSource(r)
+	if err != nil {
+		t.Fatalf("LoadSource() returned an error unexpectedly: %v", err)
+	}
+	expected := &Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": VHost{State: "up", Guests: []string{"tam"}, Source: "report"},
+			"kvm10.example.com": VHost{State: "up", Status: HostCommandFailed, Error: "error: failed to connect to the hypervisor", Source: "report"},
+		},
+		Guests: map[string]VGuest{"tam": VGuest{State: GuestRunning, Host: "kvm09.example.com", Source: "report"}},
+	}
+	if !reflect.DeepEqual(vmap, expected) || len(diags) != 1 {
+		t.Fatalf("LoadSource() failed.\nGot:\n%#v\n%v\nExpected:\n%#v", vmap, diags, expected)
+	}
+}
+
+func TestReportSourceExpire(t *testing.T) {
+	now := time.Now().UTC()
+	old, recent := now.Add(-2*time.Hour), now.Add(-time.Minute)
+	r := newReportSource()
+	r.add(libvirtHost{Name: "kvm09.example.com", Reported: &old})
+	r.add(libvirtHost{Name: "kvm10.example.com", Reported: &recent})
+	r.add(libvirtHost{Name: "kvm11.example.com", Reported: &old})
+	expired := r.expire(now.Add(-time.Hour))
+	if expected := []string{"kvm09.example.com", "kvm11.example.com"}; !reflect.DeepEqual(expired, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", expired, expected)
+	}
+	vmap, _, err := LoadSource(r)
+	if err != nil {
+		t.Fatalf("LoadSource() returned an error unexpectedly: %v", err)
+	}
+	if len(vmap.Hosts) != 1 || vmap.Hosts["kvm10.example.com"].Source != "report" {
+		t.Errorf("Got hosts %#v, expected only kvm10.example.com", vmap.Hosts)
+	}
+}
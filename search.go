@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// SearchMode is how a search query matches the names of nodes
+type SearchMode string
+
+// Search modes.  A glob is matched against the whole name, with * matching
+// any run of characters, ? any one character and [...] a class of them.
+const (
+	SearchGlob   SearchMode = "glob"
+	SearchPrefix SearchMode = "prefix"
+	SearchRegex  SearchMode = "regex"
+)
+
+// searchMatcher returns a function which tells whether a name matches
+// query in the given mode, which defaults to a glob
+func searchMatcher(query string, mode SearchMode) (func(name string) bool, error) {
+	switch mode {
+	case SearchGlob, "":
+		if _, err := path.Match(query, ""); err != nil {
+			return nil, fmt.Errorf("Bad glob %q: %v", query, err)
+		}
+		return func(name string) bool {
+			ok, _ := path.Match(query, name)
+			return ok
+		}, nil
+	case SearchPrefix:
+		return func(name string) bool {
+			return strings.HasPrefix(name, query)
+		}, nil
+	case SearchRegex:
+		re, err := regexp.Compile(query)
+		if err != nil {
+			return nil, fmt.Errorf("Bad regex %q: %v", query, err)
+		}
+		return re.MatchString, nil
+	}
+	return nil, fmt.Errorf("Bad search mode %q, expected glob, prefix or regex", mode)
+}
+
+// Search returns a new Vmap with all of the hosts and guests whose names
+// match query in the given mode.  Aliases are matched too, and find the
+// node they name.
+func (v Vmap) Search(query string, mode SearchMode) (*Vmap, error) {
+	match, err := searchMatcher(query, mode)
+	if err != nil {
+		return nil, err
+	}
+	x := &Vmap{
+		Hosts:    make(map[string]VHost),
+		Guests:   make(map[string]VGuest),
+		Restored: v.Restored,
+	}
+	add := func(name string) {
+		if h, ok := v.Hosts[name]; ok {
+			x.Hosts[name] = h
+		}
+		if g, ok := v.Guests[name]; ok {
+			x.Guests[name] = g
+		}
+	}
+	for n := range v.Hosts {
+		if match(n) {
+			add(n)
+		}
+	}
+	for n := range v.Guests {
+		if match(n) {
+			add(n)
+		}
+	}
+	for alias, n := range v.Aliases {
+		if match(alias) {
+			add(n)
+		}
+	}
+	return x, nil
+}
+
+// Search for SafeVmap wraps Vmap.Search() in a read lock
+func (s *SafeVmap) Search(query string, mode SearchMode) (*Vmap, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.Vmap.Search(query, mode)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+var searchMap = Vmap{
+	Hosts: map[string]VHost{
+		"kvm09.example.com": {State: "up", Guests: []string{"compute-64", "olh", "tam"}},
+		"kvm43.example.com": {State: "up", Guests: []string{"compute-64", "compute-65"}},
+	},
+	Guests: map[string]VGuest{
+		"tam": {State: GuestRunning, Host: "kvm09.example.com"},
+		"olh": {State: GuestShutOff, Host: "kvm09.example.com"},
+		"compute-64": {State: GuestRunning, Host: "kvm43.example.com", Placements: []Placement{
+			{Host: "kvm09.example.com", State: GuestShutOff},
+			{Host: "kvm43.example.com", State: GuestRunning},
+		}},
+		"compute-65": {State: GuestPaused, Host: "kvm43.example.com"},
+	},
+	Aliases: map[string]string{"db": "olh"},
+}
+
+func TestSearch(t *testing.T) {
+	tests := []struct {
+		query  string
+		mode   SearchMode
+		hosts  []string
+		guests []string
+		err    string
+	}{
+		{"compute-*", SearchGlob, []string{}, []string{"compute-64", "compute-65"}, ""},
+		{"compute-*", "", []string{}, []string{"compute-64", "compute-65"}, ""},
+		{"kvm?9*", SearchGlob, []string{"kvm09.example.com"}, []string{}, ""},
+		{"compute", SearchGlob, []string{}, []string{}, ""},
+		{"compute", SearchPrefix, []string{}, []string{"compute-64", "compute-65"}, ""},
+		{"kvm", SearchPrefix, []string{"kvm09.example.com", "kvm43.example.com"}, []string{}, ""},
+		{"^(tam|olh)$", SearchRegex, []string{}, []string{"olh", "tam"}, ""},
+		{`kvm\d+\.example`, SearchRegex, []string{"kvm09.example.com", "kvm43.example.com"}, []string{}, ""},
+		{"d*", SearchGlob, []string{}, []string{"olh"}, ""},
+		{"[a-", SearchGlob, nil, nil, `Bad glob "[a-": syntax error in pattern`},
+		{"(", SearchRegex, nil, nil, "Bad regex \"(\": error parsing regexp: missing closing ): `(`"},
+		{"tam", "fuzzy", nil, nil, `Bad search mode "fuzzy", expected glob, prefix or regex`},
+	}
+	for _, test := range tests {
+		got, err := searchMap.Search(test.query, test.mode)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s %s: got error %v, expected %q", test.mode, test.query, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: Search() returned an error unexpectedly: %v", test.mode, test.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got.hostNames(), test.hosts) || !reflect.DeepEqual(got.guestNames(), test.guests) {
+			t.Errorf("%s %s: got %v %v, expected %v %v", test.mode, test.query, got.hostNames(), got.guestNames(), test.hosts, test.guests)
+		}
+	}
+	// Guests are found with all of their placements
+	got, _ := searchMap.Search("compute-64", SearchGlob)
+	if !reflect.DeepEqual(got.Guests["compute-64"], searchMap.Guests["compute-64"]) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", got.Guests["compute-64"], searchMap.Guests["compute-64"])
+	}
+}
+
+func TestHandleSearch(t *testing.T) {
+	s := newServer(nil, nil)
+	v := searchMap
+	s.svmap.Replace(&v, nil)
+	tests := []struct {
+		req   string
+		code  int
+		names []string
+		error string
+	}{
+		{"/api/v1/search?q=compute-*", http.StatusOK, []string{"compute-64", "compute-65"}, ""},
+		{"/api/v1/search?q=t&mode=prefix", http.StatusOK, []string{"tam"}, ""},
+		{"/api/v1/search?q=%5Eo&mode=regex", http.StatusOK, []string{"olh"}, ""},
+		{"/api/v1/search", http.StatusBadRequest, nil, "No search query, expected e.g. ?q=compute-*"},
+		{"/api/v1/search?q=tam&mode=fuzzy", http.StatusBadRequest, nil, `Bad search mode "fuzzy", expected glob, prefix or regex`},
+	}
+	for _, test := range tests {
+		response := httptest.NewRecorder()
+		s.handleSearch(response, httptest.NewRequest("GET", test.req, nil))
+		if response.Code != test.code {
+			t.Errorf("%s: got status %d, expected %d: %s", test.req, response.Code, test.code, response.Body)
+			continue
+		}
+		var result struct {
+			Vmap
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Error != test.error {
+			t.Errorf("%s: got error %q, expected %q", test.req, result.Error, test.error)
+		}
+		if test.names != nil && !reflect.DeepEqual(result.guestNames(), test.names) {
+			t.Errorf("%s: got %v, expected %v", test.req, result.guestNames(), test.names)
+		}
+	}
+}
+
+func TestSearchClient(t *testing.T) {
+	defer func(getter func(string) (*http.Response, error)) { HTTPGetter = getter }(HTTPGetter)
+	HTTPGetter = func(url string) (*http.Response, error) {
+		if url != "http://TESTHOST/api/v1/search?mode=glob&q=compute-%2A" {
+			t.Fatalf("Search() requested the wrong URL %q", url)
+		}
+		body := `{"hosts": {}, "guests": {"compute-64": {"state": "running", "host": "kvm43.example.com"}}}`
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	}
+	got, err := Search("TESTHOST", "compute-*", SearchGlob)
+	if err != nil {
+		t.Fatalf("Search() returned an error unexpectedly: %v", err)
+	}
+	expected := &Vmap{
+		Hosts:  map[string]VHost{},
+		Guests: map[string]VGuest{"compute-64": {State: GuestRunning, Host: "kvm43.example.com"}},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", got, expected)
+	}
+}
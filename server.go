@@ -1,12 +1,18 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/urfave/cli"
@@ -18,45 +24,125 @@ const (
 
 	// VMAPPrefix is the vmap endpoint URL
 	VMAPPrefix = APIPrefix + "vmap/"
+
+	// DiagnosticsPath is the diagnostics endpoint URL
+	DiagnosticsPath = APIPrefix + "diagnostics"
+
+	// ConflictsPath is the URL of the endpoint for guests on more than one host
+	ConflictsPath = APIPrefix + "conflicts"
+
+	// HostsPrefix is the URL of the per-host endpoints, such as
+	// HostsPrefix + "{host}/report" for the reports of hosts
+	HostsPrefix = APIPrefix + "hosts/"
+
+	// ReloadPath is the URL of the endpoint for the outcome of the reloads
+	ReloadPath = APIPrefix + "reload"
+
+	// MetricsPath is the URL of the metrics in the Prometheus text format
+	MetricsPath = "/metrics"
+
+	// AdminReloadPath is the URL of the endpoint to reload the map
+	AdminReloadPath = APIPrefix + "admin/reload"
+
+	// MigrationsPath is the URL of the endpoint for the migrations of guests
+	MigrationsPath = APIPrefix + "migrations"
+
+	// GuestsPrefix is the URL of the per-guest endpoints, such as
+	// GuestsPrefix + "{guest}/history" for the history of guests
+	GuestsPrefix = APIPrefix + "guests/"
+
+	// SearchPath is the URL of the endpoint to search for nodes by name
+	SearchPath = APIPrefix + "search"
+
+	// GuestsPath is the URL of the filterable list of guests
+	GuestsPath = APIPrefix + "guests"
+
+	// HostsPath is the URL of the filterable list of hosts
+	HostsPath = APIPrefix + "hosts"
 )
 
 // ErrNodeNotFound is returned when the requested host is not present in the vmap
 var ErrNodeNotFound = errors.New("Node not found")
 
 type server struct {
-	svmap *SafeVmap
+	svmap   *SafeVmap
+	sources []Source
+	aliases map[string]string
+	// Reports pushed by hosts, also the first of the sources
+	reports *reportSource
+	// Tokens hosts must present to report, and admins to reload
+	reportTokens []string
+	adminTokens  []string
+	// Directory the snapshot is saved in after each complete reload
+	stateDir   string
+	history    *history
+	migrations *migrationLog
+	// Checks a reload must pass to replace the map
+	guard   reloadGuard
+	reloads *reloadStats
+	// Reloads are made one at a time by the reloader, from these requests
+	reloadRequests chan reloadRequest
+	// Time after which nodes which haven't been seen are stale
+	staleAfter time.Duration
+	// Labels and annotations of the nodes, read at every reload
+	metadata *metadataFile
+	// Held by reloads and reports while they change the map, so that
+	// each is made from, and its changes recorded against, the last
+	update *sync.Mutex
+}
+
+// reloadRequest asks the reloader for a reload,
+// whose outcome is sent back on result
+type reloadRequest struct {
+	cause  string
+	result chan ReloadStatus
 }
 
 // newServer creates an initialized server struct
-func newServer() server {
+func newServer(sources []Source, aliases map[string]string) server {
+	reports := newReportSource()
+	history, _ := openHistory("", 0)
 	return server{
-		svmap: &SafeVmap{},
+		svmap:          &SafeVmap{},
+		sources:        append([]Source{reports}, sources...),
+		aliases:        aliases,
+		reports:        reports,
+		reloads:        &reloadStats{},
+		reloadRequests: make(chan reloadRequest),
+		history:        history,
+		migrations:     newMigrationLog(MigrationLogSize),
+		staleAfter:     StaleAfter * time.Minute,
+		metadata:       &metadataFile{},
+		update:         &sync.Mutex{},
 	}
 }
 
 // The HTTP handler for the API.  Returns results in JSON format.
 func (s *server) handleRequest(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Server", "Virtmapper v"+Version)
-	if r.Method != "GET" {
-		err := fmt.Errorf("Bad request method: %s, only GET is allowed", r.Method)
-		log.Println(err)
-		s.respondErr(w, r, http.StatusMethodNotAllowed, err)
+	if !s.allowGet(w, r) {
 		return
 	}
-	if !strings.HasPrefix(r.URL.Path, APIPrefix) {
+	if !strings.HasPrefix(r.URL.Path, VMAPPrefix) {
 		err := fmt.Errorf("Bad request URL: %s", r.URL.Path)
 		log.Println(err)
 		s.respondErr(w, r, http.StatusNotFound, err)
 		return
 	}
 	node := strings.TrimLeft(r.URL.Path[len(VMAPPrefix):], "/")
+	if at := r.URL.Query().Get("at"); at != "" {
+		s.handleRequestAt(w, r, node, at)
+		return
+	}
 	if s.svmap.Length() == 0 {
 		log.Printf("Vmap is empty")
 	}
 	var response *Vmap
 	if node == "" {
 		log.Printf("Request for entire map, virtmap: %d nodes", s.svmap.Length())
-		response = &s.svmap.Vmap
+		s.svmap.RLock()
+		v := s.svmap.Vmap
+		s.svmap.RUnlock()
+		response = &v
 	} else {
 		log.Printf("Request for %s, virtmap: %d nodes", node, s.svmap.Length())
 		var err error
@@ -65,14 +151,340 @@ func (s *server) handleRequest(w http.ResponseWriter, r *http.Request) {
 			s.respondErr(w, r, http.StatusNotFound, fmt.Errorf("Node %s not found", node))
 			return
 		}
+		if _, ok := err.(*AmbiguousNameError); ok {
+			s.respondErr(w, r, http.StatusMultipleChoices, err)
+			return
+		}
 		if err != nil {
 			s.respondErr(w, r, http.StatusInternalServerError, err)
 			return
 		}
 	}
+	s.respond(w, r, http.StatusOK, response.markStale(s.staleAfter, time.Now()))
+}
+
+// handleRequestAt responds to a request for the map, or a node of it,
+// as it was at a time, which is rebuilt from the history
+func (s *server) handleRequestAt(w http.ResponseWriter, r *http.Request, node string, at string) {
+	t, err := parseTime(at)
+	if err != nil {
+		s.respondErr(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if start := s.history.start(); t.Before(start) {
+		s.respondErr(w, r, http.StatusBadRequest, fmt.Errorf("The history only goes back to %s", start.Format(time.RFC3339)))
+		return
+	}
+	v := s.history.mapAt(t)
+	v.Aliases = s.aliases
+	s.metadata.current().apply(v)
+	log.Printf("Request for %q at %s", node, t.Format(time.RFC3339))
+	if node == "" {
+		s.respond(w, r, http.StatusOK, v)
+		return
+	}
+	response, err := v.Get(node)
+	if err == ErrNodeNotFound {
+		s.respondErr(w, r, http.StatusNotFound, fmt.Errorf("Node %s not found at %s", node, t.Format(time.RFC3339)))
+		return
+	}
+	if _, ok := err.(*AmbiguousNameError); ok {
+		s.respondErr(w, r, http.StatusMultipleChoices, err)
+		return
+	}
+	if err != nil {
+		s.respondErr(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.respond(w, r, http.StatusOK, response)
+}
+
+// The HTTP handler for the per-guest endpoints.  The history endpoint
+// returns the changes recorded to a guest, oldest first.
+func (s *server) handleGuests(w http.ResponseWriter, r *http.Request) {
+	if !s.allowGet(w, r) {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, GuestsPrefix), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "history" {
+		err := fmt.Errorf("Bad request URL: %s", r.URL.Path)
+		log.Println(err)
+		s.respondErr(w, r, http.StatusNotFound, err)
+		return
+	}
+	var response struct {
+		Guest  string       `json:"guest"`
+		Events []GuestEvent `json:"events"`
+	}
+	response.Guest, response.Events = parts[0], s.history.guestEvents(parts[0])
+	if len(response.Events) == 0 {
+		s.respondErr(w, r, http.StatusNotFound, fmt.Errorf("Guest %s has no history", parts[0]))
+		return
+	}
+	log.Printf("Request for the history of %s, %d events", parts[0], len(response.Events))
+	s.respond(w, r, http.StatusOK, response)
+}
+
+// The HTTP handler for the diagnostics endpoint.  Returns the Diagnostics
+// from the last reload, optionally filtered by a severity parameter.
+func (s *server) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if !s.allowGet(w, r) {
+		return
+	}
+	severity := Severity(r.URL.Query().Get("severity"))
+	var response struct {
+		Diagnostics []Diagnostic `json:"diagnostics"`
+		Errors      int          `json:"errors"`
+		Warnings    int          `json:"warnings"`
+	}
+	response.Diagnostics = []Diagnostic{}
+	for _, d := range s.svmap.GetDiagnostics() {
+		if severity != "" && d.Severity != severity {
+			continue
+		}
+		response.Diagnostics = append(response.Diagnostics, d)
+		switch d.Severity {
+		case SeverityError:
+			response.Errors++
+		case SeverityWarning:
+			response.Warnings++
+		}
+	}
+	log.Printf("Request for diagnostics, %d found", len(response.Diagnostics))
+	s.respond(w, r, http.StatusOK, response)
+}
+
+// The HTTP handler for the conflicts endpoint.  Returns a Vmap of
+// the guests which are defined on more than one host.
+func (s *server) handleConflicts(w http.ResponseWriter, r *http.Request) {
+	if !s.allowGet(w, r) {
+		return
+	}
+	response := s.svmap.Conflicts()
+	log.Printf("Request for conflicts, %d found", len(response.Guests))
+	s.respond(w, r, http.StatusOK, response.markStale(s.staleAfter, time.Now()))
+}
+
+// The HTTP handler for the reload endpoint.  Returns the outcome of the
+// last reload and of the last rejected one, with the number of each.
+func (s *server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !s.allowGet(w, r) {
+		return
+	}
+	s.respond(w, r, http.StatusOK, s.reloads.report())
+}
+
+// The HTTP handler for the migrations endpoint.  Returns the latest
+// migrations, optionally only those of a guest or host, and the number
+// of migrations into and out of each host.
+func (s *server) handleMigrations(w http.ResponseWriter, r *http.Request) {
+	if !s.allowGet(w, r) {
+		return
+	}
+	response := s.migrations.report(r.URL.Query().Get("guest"), r.URL.Query().Get("host"))
+	log.Printf("Request for migrations, %d found", len(response.Migrations))
+	s.respond(w, r, http.StatusOK, response)
+}
+
+// The HTTP handler for the search endpoint.  Returns a Vmap of all of the
+// hosts and guests whose names match q, as a glob unless the mode says
+// it is a prefix or a regex.
+func (s *server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if !s.allowGet(w, r) {
+		return
+	}
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		s.respondErr(w, r, http.StatusBadRequest, errors.New("No search query, expected e.g. ?q=compute-*"))
+		return
+	}
+	response, err := s.svmap.Search(query, SearchMode(r.URL.Query().Get("mode")))
+	if err != nil {
+		s.respondErr(w, r, http.StatusBadRequest, err)
+		return
+	}
+	log.Printf("Search for %q, %d hosts and %d guests found", query, len(response.Hosts), len(response.Guests))
+	s.respond(w, r, http.StatusOK, response.markStale(s.staleAfter, time.Now()))
+}
+
+// The HTTP handler for the list of guests.  Returns a page of the guests
+// which pass the filters in the query, in the order it asks for.
+func (s *server) handleGuestList(w http.ResponseWriter, r *http.Request) {
+	if !s.allowGet(w, r) {
+		return
+	}
+	s.svmap.RLock()
+	v := s.svmap.Vmap
+	s.svmap.RUnlock()
+	response, err := v.markStale(s.staleAfter, time.Now()).listGuests(r.URL.Query())
+	if err != nil {
+		s.respondErr(w, r, http.StatusBadRequest, err)
+		return
+	}
+	log.Printf("Request for guests %q, %d of %d found", r.URL.RawQuery, len(response.Guests), response.Total)
+	s.respond(w, r, http.StatusOK, response)
+}
+
+// The HTTP handler for the list of hosts, like that of the guests
+func (s *server) handleHostList(w http.ResponseWriter, r *http.Request) {
+	if !s.allowGet(w, r) {
+		return
+	}
+	s.svmap.RLock()
+	v := s.svmap.Vmap
+	s.svmap.RUnlock()
+	response, err := v.markStale(s.staleAfter, time.Now()).listHosts(r.URL.Query())
+	if err != nil {
+		s.respondErr(w, r, http.StatusBadRequest, err)
+		return
+	}
+	log.Printf("Request for hosts %q, %d of %d found", r.URL.RawQuery, len(response.Hosts), response.Total)
 	s.respond(w, r, http.StatusOK, response)
 }
 
+// The HTTP handler for the metrics
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !s.allowGet(w, r) {
+		return
+	}
+	s.svmap.RLock()
+	hosts, guests := len(s.svmap.Hosts), len(s.svmap.Guests)
+	s.svmap.RUnlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, s.reloads.report(), hosts, guests)
+	writeMigrationMetrics(w, s.migrations.report("", ""))
+}
+
+// The HTTP handler for the per-host endpoints
+func (s *server) handleHosts(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, HostsPrefix), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "report" {
+		w.Header().Set("Server", "Virtmapper v"+Version)
+		err := fmt.Errorf("Bad request URL: %s", r.URL.Path)
+		log.Println(err)
+		s.respondErr(w, r, http.StatusNotFound, err)
+		return
+	}
+	s.handleReport(w, r, parts[0])
+}
+
+// The HTTP handler for the report endpoint.  A host pushes its own
+// "virsh list --all" output, or its domains in JSON, which replace
+// everything the map has on the host.  Returns a Vmap of the host.
+func (s *server) handleReport(w http.ResponseWriter, r *http.Request, host string) {
+	if !s.allowMethod(w, r, "POST") {
+		return
+	}
+	if len(s.reportTokens) == 0 {
+		s.respondErr(w, r, http.StatusForbidden, errors.New("Reports are disabled, no report token is configured"))
+		return
+	}
+	if !s.authorized(r, s.reportTokens) {
+		log.Printf("Unauthorized report for %s from %s", host, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="virtmapper"`)
+		s.respondErr(w, r, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxReportSize))
+	if err != nil {
+		s.respondErr(w, r, http.StatusBadRequest, fmt.Errorf("Bad report: %v", err))
+		return
+	}
+	host = s.hostName(host)
+	h, err := parseReport(host, r.Header.Get("Content-Type"), body)
+	if err != nil {
+		log.Printf("Report for %s: %v", host, err)
+		s.respondErr(w, r, http.StatusBadRequest, err)
+		return
+	}
+	now := time.Now().UTC()
+	h.Reported = &now
+	s.update.Lock()
+	v, diags := s.reports.add(h)
+	for _, d := range diags {
+		log.Println(d)
+	}
+	s.svmap.RLock()
+	prev := s.svmap.Vmap
+	s.svmap.RUnlock()
+	v.setSeen(now, &prev)
+	v.keepFirstSeen(&prev)
+	v.Aliases = s.aliases
+	s.metadata.current().apply(v)
+	s.svmap.UpdateHost(host, v)
+	s.recordChanges(&prev)
+	s.update.Unlock()
+	log.Printf("Report for %s, %d guests", host, len(h.Domains))
+	s.respond(w, r, http.StatusOK, v)
+}
+
+// The HTTP handler for the admin reload endpoint.  Reloads the map once
+// any reload already under way has finished, and returns the outcome.
+func (s *server) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if !s.allowMethod(w, r, "POST") {
+		return
+	}
+	if len(s.adminTokens) == 0 {
+		s.respondErr(w, r, http.StatusForbidden, errors.New("Admin requests are disabled, no admin token is configured"))
+		return
+	}
+	if !s.authorized(r, s.adminTokens) {
+		log.Printf("Unauthorized reload from %s", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="virtmapper"`)
+		s.respondErr(w, r, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	status, err := s.requestReload("request from "+r.RemoteAddr, r.Context().Done())
+	if err != nil {
+		s.respondErr(w, r, http.StatusServiceUnavailable, err)
+		return
+	}
+	s.respond(w, r, http.StatusOK, status)
+}
+
+// authorized reports whether the request has one of the tokens
+func (s *server) authorized(r *http.Request, tokens []string) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	ok := false
+	for _, t := range tokens {
+		if t != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// hostName returns the full name of a host already in the map which is
+// known by name, e.g. by its short name.  Otherwise name is returned.
+func (s *server) hostName(name string) string {
+	v, err := s.svmap.Get(name)
+	if err != nil || len(v.Hosts) != 1 {
+		return name
+	}
+	for n := range v.Hosts {
+		name = n
+	}
+	return name
+}
+
+// allowGet sets the common response headers and checks that the request
+// method is GET.  Otherwise it responds with an error and returns false.
+func (s *server) allowGet(w http.ResponseWriter, r *http.Request) bool {
+	return s.allowMethod(w, r, "GET")
+}
+
+// allowMethod is allowGet for any request method
+func (s *server) allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	w.Header().Set("Server", "Virtmapper v"+Version)
+	if r.Method != method {
+		err := fmt.Errorf("Bad request method: %s, only %s is allowed", r.Method, method)
+		log.Println(err)
+		s.respondErr(w, r, http.StatusMethodNotAllowed, err)
+		return false
+	}
+	return true
+}
+
 // respond is a helper to respond in JSON
 func (s *server) respond(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -101,30 +513,203 @@ func (s *server) respondErr(w http.ResponseWriter, r *http.Request, status int,
 // Registers the HTTP handler and runs the server.
 func (s *server) Serve(c *cli.Context) {
 	done := make(chan struct{})
-	s.LaunchReloader(c.String("ansibleOutputFile"), c.Int("refreshInterval"), done)
+	var changes chan string
+	if c.BoolT("watch") {
+		w := newWatcher(s.sources, time.Duration(c.Int("watchDebounce"))*time.Second, WatchPollInterval*time.Second)
+		if s.metadata.path != "" {
+			w.paths = append(w.paths, s.metadata.path)
+		}
+		if len(w.paths) > 0 {
+			changes = make(chan string)
+			go w.watch(changes, done)
+		}
+	}
+	s.restore()
+	s.LaunchReloader(c.Int("refreshInterval"), changes, done)
+	s.reloadOnSignal(done)
 	http.HandleFunc(APIPrefix, s.handleRequest)
+	http.HandleFunc(DiagnosticsPath, s.handleDiagnostics)
+	http.HandleFunc(ConflictsPath, s.handleConflicts)
+	http.HandleFunc(HostsPrefix, s.handleHosts)
+	http.HandleFunc(ReloadPath, s.handleReload)
+	http.HandleFunc(MetricsPath, s.handleMetrics)
+	http.HandleFunc(AdminReloadPath, s.handleAdminReload)
+	http.HandleFunc(GuestsPrefix, s.handleGuests)
+	http.HandleFunc(MigrationsPath, s.handleMigrations)
+	http.HandleFunc(SearchPath, s.handleSearch)
+	http.HandleFunc(GuestsPath, s.handleGuestList)
+	http.HandleFunc(HostsPath, s.handleHostList)
 	log.Println("Starting server, listening on", c.String("address"))
 	log.Fatal(http.ListenAndServe(c.String("address"), nil))
 	close(done)
 }
 
-// Reloader launches a goroutine which loads and
-// parses the ansibleOutputFile periodically
-func (s *server) LaunchReloader(ansibleOutputFile string, refresh int, done chan struct{}) {
-	var delay time.Duration
+// Reloader launches a goroutine which loads and merges the server's
+// sources periodically, whenever a watched source changes, and when
+// requested by requestReload.  changes may be nil if no sources are
+// watched.  The reloads are made one at a time.
+func (s *server) LaunchReloader(refresh int, changes <-chan string, done chan struct{}) {
 	go func() {
+		s.reload("startup")
 		for {
 			select {
-			case <-time.After(delay):
-				err := s.svmap.Load(ansibleOutputFile)
-				if err != nil {
-					log.Printf("Problem getting vmap: %s", err.Error())
-				}
-				log.Printf("Reloaded from %s, %d entries in map.\n", ansibleOutputFile, s.svmap.Length())
-				delay = time.Duration(refresh) * time.Minute
+			case <-time.After(time.Duration(refresh) * time.Minute):
+				s.reload("refresh interval")
+			case path := <-changes:
+				s.reload("changed " + path)
+			case req := <-s.reloadRequests:
+				req.result <- s.reload(req.cause)
 			case <-done:
 				return
 			}
 		}
 	}()
 }
+
+// requestReload asks the reloader for a reload and waits for its outcome.
+// It gives up if cancel is closed before the reload has started.
+func (s *server) requestReload(cause string, cancel <-chan struct{}) (ReloadStatus, error) {
+	req := reloadRequest{cause: cause, result: make(chan ReloadStatus, 1)}
+	select {
+	case s.reloadRequests <- req:
+	case <-cancel:
+		return ReloadStatus{}, errors.New("Reload canceled")
+	}
+	return <-req.result, nil
+}
+
+// reloadOnSignal requests a reload whenever the server gets a SIGHUP
+func (s *server) reloadOnSignal(done chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				s.requestReload("SIGHUP", done)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// restore loads the snapshot in the state directory, if there is one,
+// so the server has a map even if its sources can't be loaded
+func (s *server) restore() {
+	if s.stateDir == "" {
+		return
+	}
+	v, err := loadSnapshot(s.stateDir)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Problem restoring the snapshot: %v", err)
+		return
+	}
+	v.Aliases = s.aliases
+	s.svmap.Replace(v, nil)
+	log.Printf("Restored %d entries from the snapshot of %s", s.svmap.Length(), v.Restored.Loaded.Format(time.RFC3339))
+}
+
+// reload loads all of the server's sources into the map.  Nodes from
+// sources which fail to load are kept from the current map.  A reload
+// which fails the sanity checks is rejected and the whole current map
+// kept.  The cause of the reload is logged.  A map restored from a
+// snapshot stays marked as restored until all of the sources load.
+func (s *server) reload(cause string) ReloadStatus {
+	log.Printf("Reloading, cause: %s", cause)
+	status := ReloadStatus{Time: time.Now().UTC(), Cause: cause}
+	s.update.Lock()
+	defer s.update.Unlock()
+	s.svmap.RLock()
+	prev := s.svmap.Vmap
+	s.svmap.RUnlock()
+	if err := s.load(&prev, &status); err != nil {
+		status.Rejected = err.Error()
+		log.Printf("Reload rejected, keeping the previous map: %s", status.Rejected)
+	}
+	s.svmap.RLock()
+	status.Hosts, status.Guests = len(s.svmap.Hosts), len(s.svmap.Guests)
+	s.svmap.RUnlock()
+	s.reloads.add(status)
+	return status
+}
+
+// load loads the sources into the map in place of prev, recording the
+// outcome in status, unless the reload fails a sanity check, whose
+// error is returned
+func (s *server) load(prev *Vmap, status *ReloadStatus) error {
+	if err := s.guard.checkSources(s.sources); err != nil {
+		return err
+	}
+	if s.staleAfter > 0 {
+		for _, host := range s.reports.expire(status.Time.Add(-s.staleAfter)) {
+			log.Printf("Dropping the report of %s, it is older than %s", host, s.staleAfter)
+		}
+	}
+	sources, incomplete := s.guard.markSources(s.sources)
+	v, diags, loadErr := LoadSources(sources, prev)
+	if err := incomplete(); err != nil {
+		return err
+	}
+	if loadErr != nil {
+		log.Printf("Problem getting vmap: %s", loadErr.Error())
+		status.Error = loadErr.Error()
+		v.Restored = prev.Restored
+	}
+	meta, err := s.metadata.load()
+	if err != nil {
+		log.Printf("Problem loading metadata, keeping the previous labels: %v", err)
+		status.Error = strings.TrimPrefix(status.Error+"; Problem loading metadata: "+err.Error(), "; ")
+	}
+	v.Aliases = s.aliases
+	for _, key := range meta.apply(v) {
+		log.Printf("Ignoring the metadata of %s, which doesn't name one node of the map", key)
+	}
+	if err := s.guard.checkMap(prev, v); err != nil {
+		return err
+	}
+	s.svmap.Replace(v, diags)
+	s.recordChanges(prev)
+	status.Accepted = true
+	log.Printf("Reloaded from %d sources, %d entries in map, %d diagnostics.\n", len(s.sources), s.svmap.Length(), len(diags))
+	if loadErr == nil {
+		s.saveSnapshot(status.Time, v)
+	}
+	return nil
+}
+
+// recordChanges records the changes to the guests of the map since
+// prev in the history, and logs the guests which have migrated
+func (s *server) recordChanges(prev *Vmap) {
+	// The maps are replaced rather than changed, so they may be read unlocked
+	s.svmap.RLock()
+	v := s.svmap.Vmap
+	s.svmap.RUnlock()
+	now := time.Now().UTC()
+	if err := s.history.record(&v, now); err != nil {
+		log.Printf("Problem recording the history: %v", err)
+	}
+	migrations := diffMigrations(prev, &v, now)
+	for _, m := range migrations {
+		log.Printf("Migration of %s from %s to %s", m.Guest, m.From, m.To)
+	}
+	s.migrations.add(migrations)
+}
+
+// saveSnapshot saves the map loaded at the time to the state directory
+func (s *server) saveSnapshot(loaded time.Time, v *Vmap) {
+	if s.stateDir == "" {
+		return
+	}
+	info := SnapshotInfo{Loaded: loaded}
+	for _, src := range s.sources {
+		info.Sources = append(info.Sources, src.Name())
+	}
+	if err := saveSnapshot(s.stateDir, info, v); err != nil {
+		log.Printf("Problem saving the snapshot: %v", err)
+	}
+}
@@ -3,29 +3,37 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestHandleRequest(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	vmap := Vmap{
 		Hosts: map[string]VHost{
-			"kvm09": VHost{"up", []string{"olh", "tam"}},
-			"kvm43": VHost{"up", []string{"compute-64"}},
-			"kvm30": VHost{"down", []string(nil)},
-			"kvm59": VHost{"up", []string(nil)},
+			"kvm09": VHost{State: "up", Guests: []string{"olh", "tam"}},
+			"kvm43": VHost{State: "up", Guests: []string{"compute-64"}},
+			"kvm30": VHost{State: "down", Guests: []string(nil)},
+			"kvm59": VHost{State: "up", Guests: []string(nil)},
 		},
 		Guests: map[string]VGuest{
-			"tam":        VGuest{"running", "kvm09"},
-			"olh":        VGuest{"shut", "kvm09"},
-			"compute-64": VGuest{"paused", "kvm43"},
+			"tam":        VGuest{State: "running", Host: "kvm09"},
+			"olh":        VGuest{State: "shut off", Host: "kvm09"},
+			"compute-64": VGuest{State: "paused", Host: "kvm43"},
 		},
 	}
-	full := `{"hosts":{"kvm09":{"state":"up","guests":["olh","tam"]},"kvm30":{"state":"down","guests":null},"kvm43":{"state":"up","guests":["compute-64"]},"kvm59":{"state":"up","guests":null}},"guests":{"compute-64":{"state":"paused","host":"kvm43"},"olh":{"state":"shut","host":"kvm09"},"tam":{"state":"running","host":"kvm09"}}}`
+	full := `{"hosts":{"kvm09":{"state":"up","guests":["olh","tam"]},"kvm30":{"state":"down","guests":null},"kvm43":{"state":"up","guests":["compute-64"]},"kvm59":{"state":"up","guests":null}},"guests":{"compute-64":{"state":"paused","host":"kvm43"},"olh":{"state":"shut off","host":"kvm09"},"tam":{"state":"running","host":"kvm09"}}}`
 
 	tests := []struct {
 		method string
@@ -36,7 +44,7 @@ func TestHandleRequest(t *testing.T) {
 		{"GET", "/kvm09", http.StatusNotFound, `{"error":"Bad request URL: /kvm09"}`},
 		{"GET", "/api/v1/vmap/missingnode", http.StatusNotFound, `{"error":"Node missingnode not found"}`},
 		{"GET", "/api/v1/vmap/kvm09", http.StatusOK, `{"hosts":{"kvm09":{"state":"up","guests":["olh","tam"]}},"guests":null}`},
-		{"GET", "/api/v1/vmap/olh", http.StatusOK, `{"hosts":null,"guests":{"olh":{"state":"shut","host":"kvm09"}}}`},
+		{"GET", "/api/v1/vmap/olh", http.StatusOK, `{"hosts":null,"guests":{"olh":{"state":"shut off","host":"kvm09"}}}`},
 		{"GET", "/api/v1/vmap/", http.StatusOK, full},
 		{"POST", "/api/v1/vmap/", http.StatusMethodNotAllowed, `{"error":"Bad request method: POST, only GET is allowed"}`},
 	}
@@ -63,3 +71,431 @@ func TestHandleRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleConflicts(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	vmap := Vmap{
+		Hosts: map[string]VHost{
+			"kvm09": VHost{State: "up", Guests: []string{"olh", "tam"}},
+			"kvm11": VHost{State: "up", Guests: []string{"olh"}},
+		},
+		Guests: map[string]VGuest{
+			"tam": VGuest{State: "running", Host: "kvm09"},
+			"olh": VGuest{
+				State: "running",
+				Host:  "kvm09",
+				Placements: []Placement{
+					{Host: "kvm09", State: "running"},
+					{Host: "kvm11", State: "running"},
+				},
+				SplitBrain: true,
+			},
+		},
+	}
+	v := server{svmap: &SafeVmap{Vmap: vmap}}
+	request, _ := http.NewRequest("GET", ConflictsPath, nil)
+	response := httptest.NewRecorder()
+	v.handleConflicts(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code %d. Expected: %d", response.Code, http.StatusOK)
+	}
+	buffer := new(bytes.Buffer)
+	if err := json.Compact(buffer, response.Body.Bytes()); err != nil {
+		t.Fatalf("JSON Compact() error: %v\n%v", err, response.Body)
+	}
+	expected := `{"hosts":null,"guests":{"olh":{"state":"running","host":"kvm09","placements":[{"host":"kvm09","state":"running"},{"host":"kvm11","state":"running"}],"split_brain":true}}}`
+	if buffer.String() != expected {
+		t.Fatalf("Incorrect API response\nGot:\n%v\nExpected:\n%v", buffer.String(), expected)
+	}
+}
+
+func TestHandleDiagnostics(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	diags := []Diagnostic{
+		{Source: "file:/tmp/virtmapper.txt", Line: 2, Text: "kvm30.example.com | FAILED => FAILED: timed out", Reason: "host kvm30 is down, its guests are missing", Severity: SeverityWarning},
+		{Source: "file:/tmp/virtmapper.txt", Line: 9, Text: "error: failed to connect to the hypervisor", Reason: "unrecognized line in the virsh output of host kvm10", Severity: SeverityError},
+	}
+	tests := []struct {
+		method string
+		req    string
+		code   int
+		body   string
+	}{
+		{"GET", "/api/v1/diagnostics", http.StatusOK, `{"diagnostics":[{"source":"file:/tmp/virtmapper.txt","line":2,"text":"kvm30.example.com | FAILED =\u003e FAILED: timed out","reason":"host kvm30 is down, its guests are missing","severity":"warning"},{"source":"file:/tmp/virtmapper.txt","line":9,"text":"error: failed to connect to the hypervisor","reason":"unrecognized line in the virsh output of host kvm10","severity":"error"}],"errors":1,"warnings":1}`},
+		{"GET", "/api/v1/diagnostics?severity=error", http.StatusOK, `{"diagnostics":[{"source":"file:/tmp/virtmapper.txt","line":9,"text":"error: failed to connect to the hypervisor","reason":"unrecognized line in the virsh output of host kvm10","severity":"error"}],"errors":1,"warnings":0}`},
+		{"GET", "/api/v1/diagnostics?severity=info", http.StatusOK, `{"diagnostics":[],"errors":0,"warnings":0}`},
+		{"DELETE", "/api/v1/diagnostics", http.StatusMethodNotAllowed, `{"error":"Bad request method: DELETE, only GET is allowed"}`},
+	}
+	buffer := new(bytes.Buffer)
+	v := server{svmap: &SafeVmap{Diagnostics: diags}}
+	for _, tt := range tests {
+		t.Run(tt.req, func(t *testing.T) {
+			request, _ := http.NewRequest(tt.method, tt.req, nil)
+			response := httptest.NewRecorder()
+
+			v.handleDiagnostics(response, request)
+
+			if response.Code != tt.code {
+				t.Fatalf("Unexpected status code %d. Expected: %d for request %s", response.Code, tt.code, tt.req)
+			}
+			err := json.Compact(buffer, response.Body.Bytes())
+			if err != nil {
+				t.Fatalf("JSON Compact() error: %v\n%v\nOn request for: %v\n", err, response.Body, tt.req)
+			}
+			if buffer.String() != tt.body {
+				t.Fatalf("Incorrect API response\nGot:\n%v\nExpected:\n%v\nOn request for: %s", buffer.String(), tt.body, tt.req)
+			}
+			buffer.Reset()
+		})
+	}
+}
+
+func TestHandleReport(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	v := newServer(nil, nil)
+	v.reportTokens = []string{"s3cret"}
+	v.svmap.Replace(&Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": VHost{State: "up", Guests: []string{"olh", "tam"}},
+		},
+		Guests: map[string]VGuest{
+			"tam": VGuest{State: "running", Host: "kvm09.example.com"},
+			"olh": VGuest{State: "shut off", Host: "kvm09.example.com"},
+		},
+	}, nil)
+	virsh := " Id    Name                           State\n----------------------------------------------------\n 4     tam                            running\n 5     db01                           running\n"
+	tests := []struct {
+		name   string
+		method string
+		req    string
+		token  string
+		body   string
+		code   int
+		error  string
+	}{
+		{"disabled", "POST", "/api/v1/hosts/kvm09/report", "s3cret", virsh, http.StatusForbidden, "Reports are disabled, no report token is configured"},
+		{"get", "GET", "/api/v1/hosts/kvm09/report", "s3cret", "", http.StatusMethodNotAllowed, "Bad request method: GET, only POST is allowed"},
+		{"unauthorized", "POST", "/api/v1/hosts/kvm09/report", "guess", virsh, http.StatusUnauthorized, "Unauthorized"},
+		{"bad url", "POST", "/api/v1/hosts/kvm09/other", "s3cret", virsh, http.StatusNotFound, "Bad request URL: /api/v1/hosts/kvm09/other"},
+		{"bad report", "POST", "/api/v1/hosts/kvm09/report", "s3cret", "error: failed to connect to the hypervisor", http.StatusBadRequest, `Bad report: unrecognized line in the virsh output: "error: failed to connect to the hypervisor"`},
+		{"report", "POST", "/api/v1/hosts/kvm09/report", "s3cret", virsh, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "disabled" {
+				tokens := v.reportTokens
+				v.reportTokens = nil
+				defer func() { v.reportTokens = tokens }()
+			}
+			request, _ := http.NewRequest(tt.method, tt.req, bytes.NewBufferString(tt.body))
+			request.Header.Set("Authorization", "Bearer "+tt.token)
+			response := httptest.NewRecorder()
+
+			v.handleHosts(response, request)
+
+			if response.Code != tt.code {
+				t.Fatalf("Unexpected status code %d. Expected: %d for request %s: %s", response.Code, tt.code, tt.req, response.Body)
+			}
+			var result struct {
+				Error string `json:"error"`
+			}
+			json.Unmarshal(response.Body.Bytes(), &result)
+			if result.Error != tt.error {
+				t.Fatalf("Incorrect API error\nGot:\n%v\nExpected:\n%v", result.Error, tt.error)
+			}
+		})
+	}
+	// The short name in the URL is resolved and only the host's entries change
+	vmap, _ := v.svmap.Get("kvm09.example.com")
+	h := vmap.Hosts["kvm09.example.com"]
+	if !reflect.DeepEqual(h.Guests, []string{"db01", "tam"}) || h.Source != "report" || h.Reported == nil {
+		t.Fatalf("The report didn't update the host: %#v", h)
+	}
+	// The host and its guests were seen at the time of the report
+	if h.LastSeen == nil || !h.LastSeen.Equal(*h.Reported) || h.FirstSeen == nil {
+		t.Fatalf("The report didn't record when the host was seen: %#v", h)
+	}
+	if vmap, _ := v.svmap.Get("db01"); !reflect.DeepEqual(vmap.Guests["db01"].LastSeen, h.Reported) {
+		t.Fatalf("The report didn't record when db01 was seen: %#v", vmap.Guests["db01"])
+	}
+	if _, err := v.svmap.Get("olh"); err != ErrNodeNotFound {
+		t.Fatalf("The report didn't remove olh: %v", err)
+	}
+	// The report is kept at reloads
+	v.reload("test")
+	if vmap, err := v.svmap.Get("db01"); err != nil || vmap.Guests["db01"].Host != "kvm09.example.com" {
+		t.Fatalf("The report was lost at the reload: %v %#v", err, vmap)
+	}
+	// Until it is older than staleAfter
+	old := time.Now().UTC().Add(-2 * v.staleAfter)
+	v.reports.Lock()
+	report := v.reports.hosts["kvm09.example.com"]
+	report.Reported = &old
+	v.reports.hosts["kvm09.example.com"] = report
+	v.reports.Unlock()
+	v.reload("test")
+	if _, err := v.svmap.Get("db01"); err != ErrNodeNotFound {
+		t.Fatalf("The expired report was kept at the reload: %v", err)
+	}
+}
+
+// blockingSource is a source whose fetches wait to be released
+type blockingSource struct {
+	Source
+	fetching chan struct{}
+	release  chan struct{}
+}
+
+func (b *blockingSource) Fetch() (io.ReadCloser, error) {
+	b.fetching <- struct{}{}
+	<-b.release
+	return b.Source.Fetch()
+}
+
+func TestReportDuringReload(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "virtmapper.txt")
+	if err := ioutil.WriteFile(file, ansibleOutput, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := NewSources([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := newServer(sources, nil)
+	v.reportTokens = []string{"s3cret"}
+	v.reload("startup")
+	// tam has been migrated to kvm43, which the reload finds while kvm59 reports
+	migrated := strings.Replace(string(ansibleOutput), " 4     tam                            running\n", "", 1)
+	migrated = strings.Replace(migrated, " 99    compute-64                     paused\n", " 99    compute-64                     paused\n 7     tam                            running\n", 1)
+	if err := ioutil.WriteFile(file, []byte(migrated), 0644); err != nil {
+		t.Fatal(err)
+	}
+	blocking := &blockingSource{Source: v.sources[1], fetching: make(chan struct{}), release: make(chan struct{})}
+	v.sources[1] = blocking
+	reloaded := make(chan struct{})
+	go func() {
+		v.reload("test")
+		close(reloaded)
+	}()
+	<-blocking.fetching
+
+	virsh := " Id    Name                           State\n----------------------------------------------------\n 3     db01                           running\n"
+	reported := make(chan int)
+	go func() {
+		request, _ := http.NewRequest("POST", "/api/v1/hosts/kvm59/report", bytes.NewBufferString(virsh))
+		request.Header.Set("Authorization", "Bearer s3cret")
+		response := httptest.NewRecorder()
+		v.handleHosts(response, request)
+		reported <- response.Code
+	}()
+	// The report waits for the reload
+	var code int
+	select {
+	case code = <-reported:
+		t.Error("The report was made during the reload")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(blocking.release)
+	<-reloaded
+	if code == 0 {
+		code = <-reported
+	}
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status code %d. Expected: %d", code, http.StatusOK)
+	}
+
+	// The report isn't lost, and the migration is recorded once
+	if vmap, err := v.svmap.Get("db01"); err != nil || vmap.Guests["db01"].Host != "kvm59.example.com" {
+		t.Fatalf("The report was lost: %v %#v", err, vmap)
+	}
+	if report := v.migrations.report("", ""); report.Total != 1 {
+		t.Errorf("Got %d migrations, expected 1: %#v", report.Total, report.Migrations)
+	}
+}
+
+func TestReportWhileReading(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	v := newServer(nil, nil)
+	v.reportTokens = []string{"s3cret"}
+	v.svmap.Replace(&Vmap{
+		Hosts:  map[string]VHost{"kvm09.example.com": VHost{State: "up", Guests: []string{"tam"}}},
+		Guests: map[string]VGuest{"tam": VGuest{State: "running", Host: "kvm09.example.com"}},
+	}, nil)
+	virsh := " Id    Name                           State\n----------------------------------------------------\n 4     tam                            running\n"
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			request, _ := http.NewRequest("POST", "/api/v1/hosts/kvm09/report", bytes.NewBufferString(virsh))
+			request.Header.Set("Authorization", "Bearer s3cret")
+			v.handleHosts(httptest.NewRecorder(), request)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		response := httptest.NewRecorder()
+		v.handleRequest(response, httptest.NewRequest("GET", "/api/v1/vmap/", nil))
+		if response.Code != http.StatusOK {
+			t.Fatalf("Unexpected status code %d. Expected: %d", response.Code, http.StatusOK)
+		}
+	}
+	<-done
+}
+
+func TestHandleAdminReload(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "virtmapper.txt")
+	if err := ioutil.WriteFile(file, ansibleOutput, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := NewSources([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := newServer(sources, nil)
+	done := make(chan struct{})
+	defer close(done)
+	v.LaunchReloader(60, nil, done)
+	ts := httptest.NewServer(http.HandlerFunc(v.handleAdminReload))
+	defer ts.Close()
+
+	if _, err := Reload(ts.URL, "s3cret"); err == nil || err.Error() != "Admin requests are disabled, no admin token is configured" {
+		t.Errorf("Got error %v, expected admin requests to be disabled", err)
+	}
+	v.adminTokens = []string{"s3cret"}
+	if _, err := Reload(ts.URL, "guess"); err == nil || err.Error() != "Unauthorized" {
+		t.Errorf("Got error %v, expected Unauthorized", err)
+	}
+
+	// Concurrent reloads are made one after the other, and each gets its own outcome
+	if err := ioutil.WriteFile(file, ansibleOutputProblems, 0644); err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(chan *ReloadStatus, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			status, err := Reload(ts.URL, "s3cret")
+			if err != nil {
+				t.Errorf("Reload() returned an error unexpectedly: %v", err)
+			}
+			statuses <- status
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		status := <-statuses
+		if status == nil {
+			continue
+		}
+		if !status.Accepted || !strings.HasPrefix(status.Cause, "request from 127.0.0.1:") || status.Guests != 2 {
+			t.Errorf("Incorrect reload status: %#v", status)
+		}
+	}
+	if report := v.reloads.report(); report.Reloads != 4 {
+		t.Errorf("Got %d reloads, expected the startup reload and 3 requested", report.Reloads)
+	}
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no SIGHUP on Windows")
+	}
+	log.SetOutput(ioutil.Discard)
+	v := newServer(nil, nil)
+	done := make(chan struct{})
+	defer close(done)
+	v.reloadOnSignal(done)
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case req := <-v.reloadRequests:
+		if req.cause != "SIGHUP" {
+			t.Errorf("Got reload cause %q, expected SIGHUP", req.cause)
+		}
+		req.result <- ReloadStatus{}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Got no reload request after SIGHUP")
+	}
+}
+
+func TestHandleGuests(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	v := newServer(nil, nil)
+	for i, m := range historyMaps {
+		v.history.record(m, historyStart.Add(time.Duration(i)*time.Hour))
+	}
+	// The map at a time has the current labels
+	metadata, err := parseMetadata(metadataYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.metadata.last = metadata
+	tests := []struct {
+		name   string
+		req    string
+		code   int
+		error  string
+		events int
+		vmap   *Vmap
+	}{
+		{"history", "/api/v1/guests/tam/history", http.StatusOK, "", 3, nil},
+		{"no history", "/api/v1/guests/web01/history", http.StatusNotFound, "Guest web01 has no history", 0, nil},
+		{"bad url", "/api/v1/guests/tam", http.StatusNotFound, "Bad request URL: /api/v1/guests/tam", 0, nil},
+		{"at", "/api/v1/vmap/tam?at=2026-09-01T10:30:00Z", http.StatusOK, "", 0, &Vmap{
+			Guests: map[string]VGuest{"tam": {
+				State:       GuestRunning,
+				Host:        "kvm09.example.com",
+				Labels:      map[string]string{"env": "prod", "owner": "web-team"},
+				Annotations: map[string]string{"ticket": "OPS-1234"},
+			}},
+		}},
+		{"at host", "/api/v1/vmap/kvm43?at=2026-09-01T12:00:00Z", http.StatusOK, "", 0, &Vmap{
+			Hosts: map[string]VHost{"kvm43.example.com": {Guests: []string{"tam"}}},
+		}},
+		{"not yet", "/api/v1/vmap/tam?at=2026-09-01T09:00:00Z", http.StatusNotFound, "Node tam not found at 2026-09-01T09:00:00Z", 0, nil},
+		{"bad time", "/api/v1/vmap/tam?at=noon", http.StatusBadRequest, `Bad time "noon", expected e.g. 2026-09-01T12:00`, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			request := httptest.NewRequest("GET", tt.req, nil)
+			if strings.HasPrefix(tt.req, GuestsPrefix) {
+				v.handleGuests(response, request)
+			} else {
+				v.handleRequest(response, request)
+			}
+			if response.Code != tt.code {
+				t.Fatalf("Incorrect HTTP response code\nGot:\n%v\nExpected:\n%v", response.Code, tt.code)
+			}
+			var result struct {
+				Error  string       `json:"error"`
+				Events []GuestEvent `json:"events"`
+			}
+			json.Unmarshal(response.Body.Bytes(), &result)
+			if result.Error != tt.error || len(result.Events) != tt.events {
+				t.Fatalf("Incorrect API response\nGot:\n%v\nExpected error %q and %d events", response.Body.String(), tt.error, tt.events)
+			}
+			if tt.vmap != nil {
+				var vmap Vmap
+				json.Unmarshal(response.Body.Bytes(), &vmap)
+				if !reflect.DeepEqual(&vmap, tt.vmap) {
+					t.Fatalf("Got:\n%#v\nExpected:\n%#v", vmap, tt.vmap)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotFile is the name of the snapshot in the state directory
+const snapshotFile = "vmap.json"
+
+// SnapshotInfo describes a snapshot of the map: when the map
+// was loaded, and the names of the sources it was loaded from
+type SnapshotInfo struct {
+	Loaded  time.Time `json:"loaded"`
+	Sources []string  `json:"sources"`
+}
+
+// snapshot is a map saved after a reload, so the server can start
+// with it when its sources can't be loaded, e.g. after a reboot
+type snapshot struct {
+	SnapshotInfo
+	Vmap *Vmap `json:"vmap"`
+}
+
+// saveSnapshot writes a snapshot of the map to dir.  The snapshot is
+// written to a temporary file which replaces the old one, so a crash
+// can't leave a partial snapshot.
+func saveSnapshot(dir string, info SnapshotInfo, v *Vmap) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+snapshotFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := json.NewEncoder(f).Encode(snapshot{SnapshotInfo: info, Vmap: v}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, snapshotFile))
+}
+
+// loadSnapshot reads the snapshot in dir, returning the map marked
+// as restored from it
+func loadSnapshot(dir string) (*Vmap, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(dir, snapshotFile))
+	if err != nil {
+		return nil, err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(raw, &snap); err != nil {
+		return nil, err
+	}
+	v := snap.Vmap
+	if v == nil {
+		v = &Vmap{}
+	}
+	if v.Hosts == nil {
+		v.Hosts = make(map[string]VHost)
+	}
+	if v.Guests == nil {
+		v.Guests = make(map[string]VGuest)
+	}
+	v.Restored = &snap.SnapshotInfo
+	return v, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, "state")
+	if _, err := loadSnapshot(state); !os.IsNotExist(err) {
+		t.Errorf("Got error %v, expected no snapshot", err)
+	}
+
+	v, err := ParseAnsibleOutput(ansibleOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.setSource("file:/tmp/virtmapper.txt")
+	info := SnapshotInfo{Loaded: time.Date(2026, 10, 18, 6, 15, 2, 0, time.UTC), Sources: []string{"file:/tmp/virtmapper.txt"}}
+	if err := saveSnapshot(state, info, v); err != nil {
+		t.Fatalf("saveSnapshot() returned an error unexpectedly: %v", err)
+	}
+	got, err := loadSnapshot(state)
+	if err != nil {
+		t.Fatalf("loadSnapshot() returned an error unexpectedly: %v", err)
+	}
+	expected := *v
+	expected.Restored = &info
+	if !reflect.DeepEqual(*got, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", *got, expected)
+	}
+	files, _ := ioutil.ReadDir(state)
+	if len(files) != 1 || files[0].Name() != snapshotFile {
+		t.Errorf("Got files %v in the state directory, expected only the snapshot", files)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "virtmapper.txt")
+	if err := ioutil.WriteFile(file, ansibleOutput, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := NewSources([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(sources, nil)
+	s.stateDir = filepath.Join(dir, "state")
+	if status := s.reload("startup"); !status.Accepted {
+		t.Fatalf("The reload wasn't accepted: %#v", status)
+	}
+
+	// After a restart the file is gone, so the snapshot is used
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	s = newServer(sources, nil)
+	s.stateDir = filepath.Join(dir, "state")
+	s.restore()
+	s.reload("startup")
+	v, err := s.svmap.Get("compute-64")
+	if err != nil {
+		t.Fatalf("The snapshot wasn't restored: %v", err)
+	}
+	if v.Restored == nil || !reflect.DeepEqual(v.Restored.Sources, []string{"report", "file:" + file}) {
+		t.Errorf("The map isn't marked as restored: %#v", v.Restored)
+	}
+
+	// Once the sources have loaded, the map is fresh
+	if err := ioutil.WriteFile(file, ansibleOutputProblems, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.reload("test")
+	if s.svmap.Restored != nil {
+		t.Errorf("The map is still marked as restored: %#v", s.svmap.Restored)
+	}
+	snap, err := loadSnapshot(s.stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := snap.Guests["compute-64"]; ok || len(snap.Guests) != 2 {
+		t.Errorf("The snapshot wasn't saved after the reload: %#v", snap.Guests)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Source is a provider of virtual map data, such as an Ansible output file.
+// Fetch retrieves the raw data and Parse turns it into a Vmap, along with
+// Diagnostics for anything in the data which it skipped.
+type Source interface {
+	Name() string
+	Fetch() (io.ReadCloser, error)
+	Parse(r io.Reader) (*Vmap, []Diagnostic, error)
+}
+
+// SourceFactory creates a Source from the spec part of a source string
+type SourceFactory func(spec string) (Source, error)
+
+var sourceRegistry = map[string]SourceFactory{}
+
+// RegisterSource makes a kind of source available to NewSource
+func RegisterSource(kind string, factory SourceFactory) {
+	sourceRegistry[kind] = factory
+}
+
+// SourceKinds returns the names of the registered kinds of source
+func SourceKinds() []string {
+	kinds := make([]string, 0, len(sourceRegistry))
+	for k := range sourceRegistry {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func init() {
+	RegisterSource("file", newFileSource)
+	RegisterSource("url", newURLSource)
+	RegisterSource("tree", newTreeSource)
+	RegisterSource("collect", newCollectSourceFile)
+	RegisterSource("libvirt", newLibvirtSource)
+}
+
+// NewSource creates a Source from a string of the form "kind:spec",
+// e.g. "file:/tmp/virtmapper.txt".  HTTP(S) URLs are url sources and
+// a string with no registered kind is taken to be a file path.
+func NewSource(config string) (Source, error) {
+	if strings.HasPrefix(config, "http://") || strings.HasPrefix(config, "https://") {
+		return newURLSource(config)
+	}
+	kind, spec := "file", config
+	if i := strings.Index(config, ":"); i >= 0 {
+		if _, ok := sourceRegistry[config[:i]]; ok {
+			kind, spec = config[:i], config[i+1:]
+		}
+	}
+	if spec == "" {
+		return nil, fmt.Errorf("Empty %s source", kind)
+	}
+	return sourceRegistry[kind](spec)
+}
+
+// NewSources creates a Source for each of the source strings
+func NewSources(configs []string) ([]Source, error) {
+	sources := make([]Source, 0, len(configs))
+	for _, config := range configs {
+		src, err := NewSource(config)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// LoadSource fetches and parses a single source, recording the
+// source's name as the provenance of every node and Diagnostic
+func LoadSource(src Source) (*Vmap, []Diagnostic, error) {
+	rc, err := src.Fetch()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rc.Close()
+	v, diags, err := src.Parse(rc)
+	if err != nil {
+		return nil, nil, err
+	}
+	v.setSource(src.Name())
+	for i := range diags {
+		diags[i].Source = src.Name()
+	}
+	return v, diags, nil
+}
+
+// LoadSources loads all of the sources and merges them into one Vmap.
+// Sources earlier in the list take precedence over later ones.  The nodes
+// of a source which fails to load are carried over from prev, if given,
+// so one bad source doesn't empty its part of the map.  The returned
+// error describes all of the failed sources.  The nodes of each source
+// which loads are last seen when its data was modified, if that's known,
+// or else now, and the times they were first seen are kept from prev.
+// The guests of hosts which are down are also kept from prev.
+func LoadSources(sources []Source, prev *Vmap) (*Vmap, []Diagnostic, error) {
+	now := time.Now().UTC()
+	v := &Vmap{
+		Hosts:  make(map[string]VHost),
+		Guests: make(map[string]VGuest),
+		Loaded: &now,
+	}
+	var diags []Diagnostic
+	var failed []string
+	for _, src := range sources {
+		info := SourceInfo{Name: src.Name()}
+		x, d, err := LoadSource(src)
+		diags = append(diags, d...)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", src.Name(), err))
+			info.Error = err.Error()
+			if prev == nil {
+				v.Sources = append(v.Sources, info)
+				continue
+			}
+			if p, ok := prev.sourceInfo(src.Name()); ok {
+				info.Loaded, info.Modified = p.Loaded, p.Modified
+			}
+			x = prev.fromSource(src.Name())
+		} else {
+			info.Loaded = &now
+			seen := now
+			if modified, ok := sourceModified(src); ok {
+				info.Modified, seen = &modified, modified
+			}
+			x.setSeen(seen, prev)
+		}
+		v.Sources = append(v.Sources, info)
+		v.Merge(x)
+	}
+	v.keepUnreachableGuests(prev)
+	v.keepFirstSeen(prev)
+	if len(failed) > 0 {
+		return v, diags, fmt.Errorf("Problem loading sources: %s", strings.Join(failed, "; "))
+	}
+	return v, diags, nil
+}
+
+// fileSource is an Ansible output file on the local filesystem
+type fileSource struct {
+	path string
+}
+
+func newFileSource(spec string) (Source, error) {
+	return &fileSource{path: spec}, nil
+}
+
+func (f *fileSource) Name() string {
+	return "file:" + f.path
+}
+
+func (f *fileSource) Fetch() (io.ReadCloser, error) {
+	return os.Open(f.path)
+}
+
+func (f *fileSource) Parse(r io.Reader) (*Vmap, []Diagnostic, error) {
+	return ParseAnsibleReader(r)
+}
+
+// sourceHTTPClient fetches url sources.  It has a timeout so a hung
+// web server can't stall reloads indefinitely.
+var sourceHTTPClient = &http.Client{Timeout: time.Minute}
+
+// urlSource is an Ansible output file served over HTTP(S)
+type urlSource struct {
+	url string
+}
+
+func newURLSource(spec string) (Source, error) {
+	if !strings.HasPrefix(spec, "http://") && !strings.HasPrefix(spec, "https://") {
+		return nil, fmt.Errorf("Bad source URL: %s", spec)
+	}
+	return &urlSource{url: spec}, nil
+}
+
+func (u *urlSource) Name() string {
+	return u.url
+}
+
+func (u *urlSource) Fetch() (io.ReadCloser, error) {
+	resp, err := sourceHTTPClient.Get(u.url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Bad response from %s: %s", u.url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (u *urlSource) Parse(r io.Reader) (*Vmap, []Diagnostic, error) {
+	return ParseAnsibleReader(r)
+}
+
+// treeSource is a directory written by "ansible --tree", which
+// contains one JSON result file per host, named after the host
+type treeSource struct {
+	dir string
+}
+
+func newTreeSource(spec string) (Source, error) {
+	return &treeSource{dir: spec}, nil
+}
+
+func (t *treeSource) Name() string {
+	return "tree:" + t.dir
+}
+
+// Fetch gathers the per-host result files into a single document in the
+// format of the json stdout callback.  A host whose file can't be read or
+// isn't valid JSON, such as one still being written, is given as failed
+// with the error, so that it is in the map with an unknown status.
+func (t *treeSource) Fetch() (io.ReadCloser, error) {
+	files, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string]ansibleJSONHost)
+	for _, f := range files {
+		if !f.Mode().IsRegular() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(t.dir, f.Name())
+		hosts[f.Name()] = readTreeFile(path)
+	}
+	return jsonHostsDocument(hosts)
+}
+
+// readTreeFile reads the result of a host from a tree file, or a
+// failed result with the error if the file is bad
+func readTreeFile(path string) ansibleJSONHost {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ansibleJSONHost{Failed: true, Msg: fmt.Sprintf("Bad result file: %v", err)}
+	}
+	var h ansibleJSONHost
+	if err := json.Unmarshal(raw, &h); err != nil {
+		return ansibleJSONHost{Failed: true, Msg: fmt.Sprintf("Bad result file %s: %v", path, err)}
+	}
+	return h
+}
+
+// jsonHostsDocument returns the results of the hosts as a document
+// in the format of the json stdout callback
+func jsonHostsDocument(hosts map[string]ansibleJSONHost) (io.ReadCloser, error) {
+	doc := ansibleJSONOutput{
+		Plays: []ansibleJSONPlay{{Tasks: []ansibleJSONTask{{Hosts: hosts}}}},
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(raw)), nil
+}
+
+func (t *treeSource) Parse(r io.Reader) (*Vmap, []Diagnostic, error) {
+	return ParseAnsibleReader(r)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var ansibleOutputDC2 = []byte(`kvm09.example.com | success | rc=0 >>
+ Id    Name                           State
+----------------------------------------------------
+ 7     tam                            paused
+ 8     web01                          running
+
+kvm77.example.com | success | rc=0 >>
+ Id    Name                           State
+----------------------------------------------------
+ 1     db01                           running
+`)
+
+func TestNewSource(t *testing.T) {
+	tests := []struct {
+		config string
+		name   string
+		error  string
+	}{
+		{"/tmp/virtmapper.txt", "file:/tmp/virtmapper.txt", ""},
+		{"file:/tmp/virtmapper.txt", "file:/tmp/virtmapper.txt", ""},
+		{"c:virtmapper.txt", "file:c:virtmapper.txt", ""},
+		{"http://ansible.example.com/virtmapper.txt", "http://ansible.example.com/virtmapper.txt", ""},
+		{"url:https://ansible.example.com/virtmapper.txt", "https://ansible.example.com/virtmapper.txt", ""},
+		{"url:ftp://ansible.example.com/virtmapper.txt", "", "Bad source URL: ftp://ansible.example.com/virtmapper.txt"},
+		{"collect:/etc/virtmapper/hosts", "collect:/etc/virtmapper/hosts", ""},
+		{"file:", "", "Empty file source"},
+	}
+	for _, test := range tests {
+		t.Run(test.config, func(t *testing.T) {
+			src, err := NewSource(test.config)
+			if test.error != "" {
+				if err == nil || err.Error() != test.error {
+					t.Fatalf("NewSource() returned the wrong error\nGot:\n%v\nExpected:\n%v", err, test.error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewSource() returned an error unexpectedly: %v", err)
+			}
+			if src.Name() != test.name {
+				t.Fatalf("NewSource() returned the wrong source\nGot:\n%v\nExpected:\n%v", src.Name(), test.name)
+			}
+		})
+	}
+}
+
+func TestLoadSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dc1 := filepath.Join(dir, "dc1.txt")
+	if err := ioutil.WriteFile(dc1, ansibleOutput, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(ansibleOutputDC2)
+	}))
+	defer ts.Close()
+
+	// The file's nodes were last seen when it was written
+	modified := time.Date(2026, 10, 18, 6, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(dc1, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	sources, err := NewSources([]string{dc1, ts.URL})
+	if err != nil {
+		t.Fatalf("NewSources() returned an error unexpectedly: %v", err)
+	}
+	vmap, _, err := LoadSources(sources, nil)
+	if err != nil {
+		t.Fatalf("LoadSources() returned an error unexpectedly: %v", err)
+	}
+	if vmap.Loaded == nil {
+		t.Fatal("LoadSources() didn't record the time of the load")
+	}
+	// The hosts which are down have never been seen
+	// web01 of the second source is dropped, as kvm09 is taken from the first
+	file, url := "file:"+dc1, ts.URL
+	expectedMap := func(loaded, urlFirstSeen, urlLastSeen *time.Time, fileErr string) *Vmap {
+		m := &modified
+		return &Vmap{
+			Hosts: map[string]VHost{
+				"kvm09.example.com": VHost{State: "up", Guests: []string{"olh", "tam"}, Source: file, FirstSeen: m, LastSeen: m},
+				"kvm43.example.com": VHost{State: "up", Guests: []string{"compute-64"}, Source: file, FirstSeen: m, LastSeen: m},
+				"kvm21.example.com": VHost{State: "down", Guests: []string(nil), Status: HostUnreachableDNS, Error: "FAILED: [Errno -2] Name or service not known", Source: file, FirstSeen: m},
+				"kvm30.example.com": VHost{State: "down", Guests: []string(nil), Status: HostTimeout, Error: "FAILED: timed out", Source: file, FirstSeen: m},
+				"kvm59.example.com": VHost{State: "up", Guests: []string(nil), Source: file, FirstSeen: m, LastSeen: m},
+				"kvm77.example.com": VHost{State: "up", Guests: []string{"db01"}, Source: url, FirstSeen: urlFirstSeen, LastSeen: urlLastSeen},
+			},
+			Guests: map[string]VGuest{
+				"tam":        VGuest{State: "running", Host: "kvm09.example.com", Source: file, FirstSeen: m, LastSeen: m},
+				"olh":        VGuest{State: "shut off", Host: "kvm09.example.com", Source: file, FirstSeen: m, LastSeen: m},
+				"compute-64": VGuest{State: "paused", Host: "kvm43.example.com", Source: file, FirstSeen: m, LastSeen: m},
+				"db01":       VGuest{State: "running", Host: "kvm77.example.com", Source: url, FirstSeen: urlFirstSeen, LastSeen: urlLastSeen},
+			},
+			Loaded: loaded,
+			Sources: []SourceInfo{
+				{Name: file, Loaded: vmap.Loaded, Modified: m, Error: fileErr},
+				{Name: url, Loaded: loaded},
+			},
+		}
+	}
+	expected := expectedMap(vmap.Loaded, vmap.Loaded, vmap.Loaded, "")
+	if !reflect.DeepEqual(vmap, expected) {
+		t.Fatalf("LoadSources() failed.\nGot:\n%#v\nExpected:\n%#v", vmap, expected)
+	}
+
+	// A failed source keeps its nodes from the previous map, which
+	// were last seen at the previous load
+	os.Remove(dc1)
+	reloaded, _, err := LoadSources(sources, vmap)
+	if err == nil {
+		t.Fatal("LoadSources() didn't report the missing file")
+	}
+	_, openErr := os.Open(dc1)
+	expected = expectedMap(reloaded.Loaded, vmap.Loaded, reloaded.Loaded, openErr.Error())
+	if !reflect.DeepEqual(reloaded, expected) {
+		t.Fatalf("LoadSources() didn't carry over the failed source.\nGot:\n%#v\nExpected:\n%#v", reloaded, expected)
+	}
+}
+
+func TestTreeSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"kvm09.example.com": `{"changed": true, "rc": 0, "stdout": " Id    Name                           State\n----------------------------------------------------\n 4     tam                            running\n -     olh                            shut off"}`,
+		"kvm21.example.com": `{"changed": false, "msg": "Failed to connect to the host via ssh: ssh: Could not resolve hostname kvm21.example.com: Name or service not known", "unreachable": true}`,
+		"kvm30.example.com": `{"changed": false, "msg": "Failed to connect to the host via ssh: ssh: connect to host kvm30.example.com port 22: Connection timed out", "unreachable": true}`,
+		"kvm43.example.com": `{"changed": true, "rc": 0, "stdout": " Id    Name                           State\n----------------------------------------------------\n 99    compute-64                     paused"}`,
+		"kvm59.example.com": `{"changed": true, "rc": 0, "stdout": " Id    Name                           State\n----------------------------------------------------"}`,
+		// A host whose result is still being written
+		"kvm88.example.com": `{"changed": true, "rc": 0, "stdout": " Id    Name`,
+		".kvm99.swp":        `garbage`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src, err := NewSource("tree:" + dir)
+	if err != nil {
+		t.Fatalf("NewSource() returned an error unexpectedly: %v", err)
+	}
+	vmap, diags, err := LoadSource(src)
+	if err != nil {
+		t.Fatalf("LoadSource() returned an error unexpectedly: %v", err)
+	}
+
+	// The host whose file is bad is in the map with the error
+	bad := vmap.Hosts["kvm88.example.com"]
+	expectedError := "Bad result file " + filepath.Join(dir, "kvm88.example.com") + ": unexpected end of JSON input"
+	if bad.State != "down" || bad.Status != HostUnknown || bad.Error != expectedError {
+		t.Errorf("Got:\n%#v\nExpected a host down with status %q and error %q", bad, HostUnknown, expectedError)
+	}
+	warned := false
+	for _, d := range diags {
+		warned = warned || strings.Contains(d.Reason, "kvm88.example.com")
+	}
+	if !warned {
+		t.Errorf("No warning for kvm88.example.com in %#v", diags)
+	}
+	delete(vmap.Hosts, "kvm88.example.com")
+
+	expected, _ := ParseAnsibleOutput(ansibleOutput)
+	expected.setSource("tree:" + dir)
+	if !reflect.DeepEqual(withoutHostErrors(vmap), withoutHostErrors(expected)) {
+		t.Fatalf("LoadSource() failed.\nGot:\n%#v\nExpected:\n%#v", vmap, expected)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SourceInfo describes the last load of a source.  Loaded is the time the
+// source last loaded, which is kept from the previous load if it failed
+// this time, with the failure in Error.  Modified is the modification time
+// of the data of a file or tree source.
+type SourceInfo struct {
+	Name     string     `json:"name"`
+	Loaded   *time.Time `json:"loaded,omitempty"`
+	Modified *time.Time `json:"modified,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// sourceInfo returns the SourceInfo of the named source in the map
+func (v Vmap) sourceInfo(name string) (SourceInfo, bool) {
+	for _, info := range v.Sources {
+		if info.Name == name {
+			return info, true
+		}
+	}
+	return SourceInfo{}, false
+}
+
+// sourceModified returns the modification time of the data of a
+// source, which is only known for those read from files
+func sourceModified(src Source) (time.Time, bool) {
+	w, ok := src.(watchedSource)
+	if !ok {
+		return time.Time{}, false
+	}
+	modified, err := lastModified(w.WatchPath())
+	if err != nil {
+		return time.Time{}, false
+	}
+	return modified.UTC(), true
+}
+
+// setSeen records that the nodes of the map were seen at the given time.
+// A host which reported its own guests was seen at the time of its report,
+// and a guest when its host was seen.  A host which couldn't be reached
+// wasn't seen, so it keeps the time it was last seen in prev, which may
+// be nil, and if it has never been seen it is first seen now.
+func (v *Vmap) setSeen(at time.Time, prev *Vmap) {
+	if prev == nil {
+		prev = &Vmap{}
+	}
+	for n, h := range v.Hosts {
+		seen := at
+		if h.Reported != nil {
+			seen = *h.Reported
+		}
+		h.LastSeen = &seen
+		if !h.reachable() {
+			h.LastSeen = prev.Hosts[n].LastSeen
+			if h.LastSeen == nil {
+				h.FirstSeen = &seen
+			}
+		}
+		v.Hosts[n] = h
+	}
+	for n, g := range v.Guests {
+		seen := at
+		if h, ok := v.Hosts[g.Host]; ok && h.LastSeen != nil {
+			seen = *h.LastSeen
+		}
+		g.LastSeen = &seen
+		v.Guests[n] = g
+	}
+}
+
+// reachable tells whether the host could be reached to list its guests
+func (h VHost) reachable() bool {
+	return h.State != "down" && (h.Status == "" || h.Status == HostUp)
+}
+
+// keepFirstSeen carries the time each node was first seen over from
+// prev, which may be nil.  Nodes which weren't in prev were first seen
+// when last seen, so a node which leaves the map and comes back is seen
+// afresh.
+func (v *Vmap) keepFirstSeen(prev *Vmap) {
+	if prev == nil {
+		prev = &Vmap{}
+	}
+	for n, h := range v.Hosts {
+		if h.LastSeen != nil {
+			h.FirstSeen = h.LastSeen
+		}
+		if p, ok := prev.Hosts[n]; ok && p.FirstSeen != nil {
+			h.FirstSeen = p.FirstSeen
+		}
+		v.Hosts[n] = h
+	}
+	for n, g := range v.Guests {
+		g.FirstSeen = g.LastSeen
+		if p, ok := prev.Guests[n]; ok && p.FirstSeen != nil {
+			g.FirstSeen = p.FirstSeen
+		}
+		v.Guests[n] = g
+	}
+}
+
+// keepUnreachableGuests carries the guests of each host which can't be
+// reached, or whose guests couldn't be listed, over from prev, which may
+// be nil, so the guests affected by an outage stay in the map.  Their
+// state is unknown, and they keep the time they were last seen on the
+// host.  A guest now found on another host isn't carried over.
+func (v *Vmap) keepUnreachableGuests(prev *Vmap) {
+	if prev == nil {
+		return
+	}
+	for name, h := range v.Hosts {
+		p, ok := prev.Hosts[name]
+		if h.reachable() || !ok {
+			continue
+		}
+		guests := append([]string(nil), h.Guests...)
+		for _, n := range p.Guests {
+			g, ok := prev.Guests[n]
+			if _, found := v.Guests[n]; found || !ok {
+				continue
+			}
+			v.Guests[n] = VGuest{
+				State:     GuestHostUnreachable,
+				Host:      name,
+				UUID:      g.UUID,
+				VCPUs:     g.VCPUs,
+				MemoryKiB: g.MemoryKiB,
+				Source:    h.Source,
+				FirstSeen: g.FirstSeen,
+				LastSeen:  g.LastSeen,
+			}
+			guests = append(guests, n)
+		}
+		sort.Strings(guests)
+		h.Guests = guests
+		v.Hosts[name] = h
+	}
+}
+
+// isStale tells whether a node last seen at lastSeen is stale at now,
+// having not been seen for longer than after.  Nodes are never stale
+// if after is 0.
+func isStale(lastSeen *time.Time, after time.Duration, now time.Time) bool {
+	return after > 0 && lastSeen != nil && now.Sub(*lastSeen) > after
+}
+
+// markStale returns a copy of the map with the nodes which
+// haven't been seen for longer than after marked as stale
+func (v Vmap) markStale(after time.Duration, now time.Time) *Vmap {
+	x := v
+	if after <= 0 {
+		return &x
+	}
+	if v.Hosts != nil {
+		x.Hosts = make(map[string]VHost, len(v.Hosts))
+		for n, h := range v.Hosts {
+			// A host which has never been reached is stale from when it was first seen
+			seen := h.LastSeen
+			if seen == nil {
+				seen = h.FirstSeen
+			}
+			h.Stale = isStale(seen, after, now)
+			x.Hosts[n] = h
+		}
+	}
+	if v.Guests != nil {
+		x.Guests = make(map[string]VGuest, len(v.Guests))
+		for n, g := range v.Guests {
+			g.Stale = isStale(g.LastSeen, after, now)
+			x.Guests[n] = g
+		}
+	}
+	return &x
+}
+
+// UnreachableWarning returns a warning if the guest's host is unreachable
+func UnreachableWarning(name string, g VGuest) string {
+	if g.State != GuestHostUnreachable {
+		return ""
+	}
+	if g.LastSeen == nil {
+		return fmt.Sprintf("Warning: %s is unreachable, the state of %s is unknown", g.Host, name)
+	}
+	return fmt.Sprintf("Warning: %s is unreachable, the state of %s is unknown, it was last confirmed at %s", g.Host, name,
+		g.LastSeen.Local().Format("2006-01-02 15:04:05"))
+}
+
+// StaleWarning returns a warning if a node is stale
+func StaleWarning(name string, stale bool, lastSeen *time.Time) string {
+	if !stale || lastSeen == nil {
+		return ""
+	}
+	return fmt.Sprintf("Warning: %s is stale, it was last seen at %s, %v ago", name,
+		lastSeen.Local().Format("2006-01-02 15:04:05"), time.Since(*lastSeen).Round(time.Minute))
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetSeen(t *testing.T) {
+	loaded := time.Date(2026, 10, 18, 6, 0, 0, 0, time.UTC)
+	reported := loaded.Add(-5 * time.Minute)
+	first := loaded.Add(-24 * time.Hour)
+	v := &Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": {State: "up", Guests: []string{"tam"}},
+			"kvm43.example.com": {State: "up", Guests: []string{"compute-64"}, Reported: &reported},
+		},
+		Guests: map[string]VGuest{
+			"tam":        {State: GuestRunning, Host: "kvm09.example.com"},
+			"compute-64": {State: GuestPaused, Host: "kvm43.example.com"},
+			"web01":      {State: GuestRunning, Host: "kvm77.example.com"},
+		},
+	}
+	prev := &Vmap{
+		Guests: map[string]VGuest{
+			"tam": {State: GuestRunning, Host: "kvm09.example.com", FirstSeen: &first, LastSeen: &first},
+		},
+	}
+	v.setSeen(loaded, prev)
+	v.keepFirstSeen(prev)
+
+	expected := &Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": {State: "up", Guests: []string{"tam"}, FirstSeen: &loaded, LastSeen: &loaded},
+			"kvm43.example.com": {State: "up", Guests: []string{"compute-64"}, Reported: &reported, FirstSeen: &reported, LastSeen: &reported},
+		},
+		Guests: map[string]VGuest{
+			"tam":        {State: GuestRunning, Host: "kvm09.example.com", FirstSeen: &first, LastSeen: &loaded},
+			"compute-64": {State: GuestPaused, Host: "kvm43.example.com", FirstSeen: &reported, LastSeen: &reported},
+			"web01":      {State: GuestRunning, Host: "kvm77.example.com", FirstSeen: &loaded, LastSeen: &loaded},
+		},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", v, expected)
+	}
+}
+
+func TestSetSeenUnreachable(t *testing.T) {
+	loaded := time.Date(2026, 10, 18, 6, 0, 0, 0, time.UTC)
+	old := loaded.Add(-72 * time.Hour)
+	v := &Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": {State: "down", Status: HostTimeout},
+			"kvm21.example.com": {State: "down", Status: HostUnreachableDNS},
+		},
+		Guests: map[string]VGuest{},
+	}
+	prev := &Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": {State: "up", Guests: []string{"tam"}, FirstSeen: &old, LastSeen: &old},
+		},
+	}
+	v.setSeen(loaded, prev)
+	v.keepFirstSeen(prev)
+
+	// kvm09 keeps the time it was last reached, and kvm21 has never been reached
+	expected := map[string]VHost{
+		"kvm09.example.com": {State: "down", Status: HostTimeout, FirstSeen: &old, LastSeen: &old},
+		"kvm21.example.com": {State: "down", Status: HostUnreachableDNS, FirstSeen: &loaded},
+	}
+	if !reflect.DeepEqual(v.Hosts, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", v.Hosts, expected)
+	}
+	// Both are stale once they haven't been reached for long enough
+	x := v.markStale(time.Hour, loaded.Add(2*time.Hour))
+	if !x.Hosts["kvm09.example.com"].Stale || !x.Hosts["kvm21.example.com"].Stale {
+		t.Errorf("The unreachable hosts weren't marked as stale: %#v", x.Hosts)
+	}
+}
+
+func TestMarkStale(t *testing.T) {
+	now := time.Date(2026, 10, 18, 6, 0, 0, 0, time.UTC)
+	recent, old := now.Add(-time.Hour), now.Add(-4*time.Hour)
+	v := Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": {State: "up", Guests: []string{"tam"}, LastSeen: &recent},
+			"kvm21.example.com": {State: "down", LastSeen: &old},
+		},
+		Guests: map[string]VGuest{
+			"tam":  {State: GuestRunning, Host: "kvm09.example.com", LastSeen: &recent},
+			"olh":  {State: GuestShutOff, Host: "kvm21.example.com", LastSeen: &old},
+			"db01": {State: GuestRunning, Host: "kvm77.example.com"},
+		},
+	}
+	tests := []struct {
+		after       time.Duration
+		staleHosts  []string
+		staleGuests []string
+	}{
+		{3 * time.Hour, []string{"kvm21.example.com"}, []string{"olh"}},
+		{30 * time.Minute, []string{"kvm09.example.com", "kvm21.example.com"}, []string{"olh", "tam"}},
+		{0, nil, nil},
+	}
+	for _, test := range tests {
+		x := v.markStale(test.after, now)
+		var hosts, guests []string
+		for n, h := range x.Hosts {
+			if h.Stale {
+				hosts = append(hosts, n)
+			}
+		}
+		for n, g := range x.Guests {
+			if g.Stale {
+				guests = append(guests, n)
+			}
+		}
+		sort.Strings(hosts)
+		sort.Strings(guests)
+		if !reflect.DeepEqual(hosts, test.staleHosts) || !reflect.DeepEqual(guests, test.staleGuests) {
+			t.Errorf("After %v got stale %v %v, expected %v %v", test.after, hosts, guests, test.staleHosts, test.staleGuests)
+		}
+	}
+	// The map itself isn't marked
+	if v.Hosts["kvm21.example.com"].Stale || v.Guests["olh"].Stale {
+		t.Error("markStale() changed the map")
+	}
+}
+
+func TestHandleRequestStale(t *testing.T) {
+	recent, old := time.Now().Add(-time.Hour).UTC(), time.Now().Add(-4*time.Hour).UTC()
+	s := newServer(nil, nil)
+	s.staleAfter = 3 * time.Hour
+	s.svmap.Replace(&Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": {State: "up", Guests: []string{"tam"}, LastSeen: &recent},
+		},
+		Guests: map[string]VGuest{
+			"tam": {State: GuestRunning, Host: "kvm09.example.com", LastSeen: &old},
+		},
+	}, nil)
+	tests := []struct {
+		req   string
+		stale bool
+	}{
+		{"/api/v1/vmap/tam", true},
+		{"/api/v1/vmap/kvm09.example.com", false},
+	}
+	for _, test := range tests {
+		response := httptest.NewRecorder()
+		s.handleRequest(response, httptest.NewRequest("GET", test.req, nil))
+		var v Vmap
+		if err := json.Unmarshal(response.Body.Bytes(), &v); err != nil {
+			t.Fatal(err)
+		}
+		stale := v.Guests["tam"].Stale || v.Hosts["kvm09.example.com"].Stale
+		if stale != test.stale {
+			t.Errorf("%s: got stale %v, expected %v: %s", test.req, stale, test.stale, response.Body.String())
+		}
+	}
+}
+
+func TestStaleWarning(t *testing.T) {
+	seen := time.Now().Add(-4 * time.Hour)
+	if got := StaleWarning("tam", false, &seen); got != "" {
+		t.Errorf("Got a warning for a fresh guest: %s", got)
+	}
+	got := StaleWarning("tam", true, &seen)
+	expected := "Warning: tam is stale, it was last seen at " + seen.Local().Format("2006-01-02 15:04:05") + ", 4h0m0s ago"
+	if got != expected {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", got, expected)
+	}
+}
+
+func TestKeepUnreachableGuests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "virtmapper.txt")
+	if err := ioutil.WriteFile(file, ansibleOnelineOutput, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := NewSources([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev, _, err := LoadSources(sources, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// kvm09 times out, virsh fails on kvm43, and olh has moved to kvm59 meanwhile
+	lines := strings.Split(string(ansibleOnelineOutput), "\n")
+	lines[1] = "kvm09.example.com | FAILED => FAILED: timed out"
+	lines[2] = "kvm43.example.com | FAILED | rc=1 | (stdout)  | (stderr) error: failed to connect to the hypervisor"
+	lines[4] = `kvm59.example.com | success | rc=0 | (stdout)  Id    Name                           State\n----------------------------------------------------\n 7     olh                            running\n`
+	if err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	v, _, err := LoadSources(sources, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := VGuest{
+		State:     GuestHostUnreachable,
+		Host:      "kvm09.example.com",
+		Source:    "file:" + file,
+		FirstSeen: prev.Guests["tam"].FirstSeen,
+		LastSeen:  prev.Guests["tam"].LastSeen,
+	}
+	if got := v.Guests["tam"]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", got, expected)
+	}
+	if got := v.Guests["olh"]; got.Host != "kvm59.example.com" || got.State != GuestRunning {
+		t.Errorf("olh was carried over though it's on another host: %#v", got)
+	}
+	if got := v.Hosts["kvm09.example.com"].Guests; !reflect.DeepEqual(got, []string{"tam"}) {
+		t.Errorf("Got guests of kvm09 %#v, expected only tam", got)
+	}
+	// A host whose guests couldn't be listed keeps them too
+	if h := v.Hosts["kvm43.example.com"]; h.Status != HostCommandFailed || !reflect.DeepEqual(h.Guests, []string{"compute-64"}) {
+		t.Errorf("Got kvm43 %#v, expected it to fail with compute-64 kept", h)
+	}
+	if got := v.Guests["compute-64"]; got.State != GuestHostUnreachable || got.Host != "kvm43.example.com" {
+		t.Errorf("compute-64 wasn't carried over from kvm43: %#v", got)
+	}
+
+	// The guests stay while the host is down, still last seen before it went down
+	v, _, err = LoadSources(sources, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := v.Guests["tam"]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", got, expected)
+	}
+}
+
+func TestUnreachableWarning(t *testing.T) {
+	seen := time.Now().Add(-time.Hour)
+	tests := []struct {
+		g        VGuest
+		expected string
+	}{
+		{VGuest{State: GuestRunning, Host: "kvm09.example.com", LastSeen: &seen}, ""},
+		{VGuest{State: GuestHostUnreachable, Host: "kvm09.example.com", LastSeen: &seen},
+			"Warning: kvm09.example.com is unreachable, the state of tam is unknown, it was last confirmed at " + seen.Local().Format("2006-01-02 15:04:05")},
+		{VGuest{State: GuestHostUnreachable, Host: "kvm09.example.com"}, "Warning: kvm09.example.com is unreachable, the state of tam is unknown"},
+	}
+	for _, test := range tests {
+		if got := UnreachableWarning("tam", test.g); got != test.expected {
+			t.Errorf("Got:\n%#v\nExpected:\n%#v", got, test.expected)
+		}
+	}
+}
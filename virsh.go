@@ -0,0 +1,198 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// GuestState is the state of a virtual guest, named as libvirt reports it
+type GuestState string
+
+// Guest states as shown by "virsh list --all"
+const (
+	GuestNoState     GuestState = "no state"
+	GuestRunning     GuestState = "running"
+	GuestIdle        GuestState = "idle"
+	GuestPaused      GuestState = "paused"
+	GuestInShutdown  GuestState = "in shutdown"
+	GuestShutOff     GuestState = "shut off"
+	GuestCrashed     GuestState = "crashed"
+	GuestPMSuspended GuestState = "pmsuspended"
+)
+
+// GuestHostUnreachable is the state of a guest last seen on a host which
+// is now unreachable, so its actual state is unknown.  virsh never reports
+// it, so it isn't one of the GuestStates.
+const GuestHostUnreachable GuestState = "unknown (host unreachable)"
+
+// GuestStates lists all of the known guest states
+var GuestStates = []GuestState{
+	GuestNoState,
+	GuestRunning,
+	GuestIdle,
+	GuestPaused,
+	GuestInShutdown,
+	GuestShutOff,
+	GuestCrashed,
+	GuestPMSuspended,
+}
+
+// ParseGuestState returns the GuestState named by s.
+// ok is false if s is not a known state.
+func ParseGuestState(s string) (state GuestState, ok bool) {
+	for _, state := range GuestStates {
+		if string(state) == s {
+			return state, true
+		}
+	}
+	s = strings.Join(strings.Fields(s), " ")
+	for _, state := range GuestStates {
+		if string(state) == s {
+			return state, true
+		}
+	}
+	return GuestState(s), false
+}
+
+// Known reports whether s is one of the GuestStates
+func (s GuestState) Known() bool {
+	_, ok := ParseGuestState(string(s))
+	return ok
+}
+
+// virshDomain is one row of the "virsh list --all" table.
+// Line is the index of the row's line in the output.
+type virshDomain struct {
+	ID    string
+	Name  string
+	State GuestState
+	Line  int
+}
+
+// virshColumns holds the offsets of the columns of the
+// "virsh list" table, taken from its header line
+type virshColumns struct {
+	name, state int
+}
+
+// parseVirshHeader returns the column offsets if line
+// is the header of the "virsh list" table
+func parseVirshHeader(line string) (virshColumns, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[0] != "Id" || fields[1] != "Name" || fields[2] != "State" {
+		return virshColumns{}, false
+	}
+	return virshColumns{
+		name:  strings.Index(line, " Name") + 1,
+		state: strings.Index(line, " State") + 1,
+	}, true
+}
+
+// virshListParser parses the table printed by "virsh list --all" a line
+// at a time.  The columns are located using the header line, so guest names
+// and states containing spaces (e.g. "shut off") are read whole.  A name too
+// long for its column pushes the state to the right, so the state is then
+// matched at the end of the line instead.
+type virshListParser struct {
+	cols   virshColumns
+	header bool
+}
+
+// virshLine is the kind of a line of "virsh list" output
+type virshLine int
+
+const (
+	virshSkipped virshLine = iota // header, dashed and blank lines
+	virshRow
+	virshUnrecognized
+)
+
+// parseLine parses one line of the table, returning the
+// domain when the line is a virshRow
+func (p *virshListParser) parseLine(line string) (virshDomain, virshLine) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.Trim(trimmed, "-") == "" {
+		return virshDomain{}, virshSkipped
+	}
+	if strings.HasPrefix(trimmed, "Id ") {
+		if c, ok := parseVirshHeader(line); ok {
+			p.cols, p.header = c, true
+			return virshDomain{}, virshSkipped
+		}
+	}
+	cols := p.cols
+	if !p.header {
+		// Without a header, assume the name starts at the second field
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return virshDomain{}, virshUnrecognized
+		}
+		end := strings.Index(line, fields[0]) + len(fields[0])
+		cols.name = end + strings.Index(line[end:], fields[1])
+		cols.state = -1
+	}
+	if len(line) <= cols.name || !isVirshID(strings.TrimSpace(line[:cols.name])) {
+		return virshDomain{}, virshUnrecognized
+	}
+	d, ok := parseVirshRow(line, cols)
+	if !ok {
+		return virshDomain{}, virshUnrecognized
+	}
+	return d, virshRow
+}
+
+// parseVirshList parses the whole of the "virsh list --all" output.
+// The indexes of any lines which aren't part of the table are
+// returned as unrecognized.
+func parseVirshList(output string) (domains []virshDomain, unrecognized []int) {
+	var p virshListParser
+	for i, line := range strings.Split(output, "\n") {
+		d, kind := p.parseLine(line)
+		switch kind {
+		case virshRow:
+			d.Line = i
+			domains = append(domains, d)
+		case virshUnrecognized:
+			unrecognized = append(unrecognized, i)
+		}
+	}
+	return domains, unrecognized
+}
+
+// isVirshID reports whether id is a domain id, which is
+// a number for running guests and "-" for inactive ones
+func isVirshID(id string) bool {
+	if id == "-" {
+		return true
+	}
+	_, err := strconv.Atoi(id)
+	return err == nil
+}
+
+// parseVirshRow parses one guest line of the "virsh list" table
+func parseVirshRow(line string, cols virshColumns) (virshDomain, bool) {
+	d := virshDomain{ID: strings.TrimSpace(line[:cols.name])}
+	rest := strings.TrimRight(line[cols.name:], " \t\r")
+	if cols.state > cols.name && cols.state < len(line) && line[cols.state-1] == ' ' {
+		if state, ok := ParseGuestState(line[cols.state:]); ok {
+			d.Name = strings.TrimSpace(line[cols.name:cols.state])
+			d.State = state
+			return d, d.Name != ""
+		}
+	}
+	for _, state := range GuestStates {
+		if strings.HasSuffix(rest, " "+string(state)) {
+			d.Name = strings.TrimSpace(strings.TrimSuffix(rest, string(state)))
+			d.State = state
+			return d, d.Name != ""
+		}
+	}
+	// An unknown state, assume it is the last field
+	i := strings.LastIndexAny(rest, " \t")
+	if i < 0 {
+		return d, false
+	}
+	d.Name = strings.TrimSpace(rest[:i])
+	d.State, _ = ParseGuestState(rest[i+1:])
+	return d, d.Name != ""
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVirshList(t *testing.T) {
+	tests := []struct {
+		name         string
+		output       string
+		domains      []virshDomain
+		unrecognized []int
+	}{
+		{
+			"fixed width",
+			` Id    Name                           State
+----------------------------------------------------
+ 4     tam                            running
+ 12    pm                             pmsuspended
+ -     olh                            shut off
+ 7     going                          in shutdown
+`,
+			[]virshDomain{
+				{"4", "tam", GuestRunning, 2},
+				{"12", "pm", GuestPMSuspended, 3},
+				{"-", "olh", GuestShutOff, 4},
+				{"7", "going", GuestInShutdown, 5},
+			},
+			nil,
+		},
+		{
+			"dynamic width",
+			` Id   Name         State
+-----------------------------
+ 1    compute-64   idle
+ -    my guest     shut off
+ 3    dead         crashed
+`,
+			[]virshDomain{
+				{"1", "compute-64", GuestIdle, 2},
+				{"-", "my guest", GuestShutOff, 3},
+				{"3", "dead", GuestCrashed, 4},
+			},
+			nil,
+		},
+		{
+			"overlong name",
+			` Id    Name                           State
+----------------------------------------------------
+ 5     a-guest-name-longer-than-thirty-characters shut off
+ 6     ok                             paused
+`,
+			[]virshDomain{
+				{"5", "a-guest-name-longer-than-thirty-characters", GuestShutOff, 2},
+				{"6", "ok", GuestPaused, 3},
+			},
+			nil,
+		},
+		{
+			"unknown state",
+			` Id    Name                           State
+----------------------------------------------------
+ 5     odd                            sleepy
+`,
+			[]virshDomain{
+				{"5", "odd", GuestState("sleepy"), 2},
+			},
+			nil,
+		},
+		{
+			"no header",
+			` 4     tam                            running
+ -     olh                            shut off
+`,
+			[]virshDomain{
+				{"4", "tam", GuestRunning, 0},
+				{"-", "olh", GuestShutOff, 1},
+			},
+			nil,
+		},
+		{
+			"unrecognized lines",
+			` Id    Name                           State
+----------------------------------------------------
+ 4     tam                            running
+garbage
+ x     bad                            running
+ -     olh                            shut off
+`,
+			[]virshDomain{
+				{"4", "tam", GuestRunning, 2},
+				{"-", "olh", GuestShutOff, 5},
+			},
+			[]int{3, 4},
+		},
+		{
+			"error",
+			`error: failed to connect to the hypervisor
+error: Failed to connect socket to '/var/run/libvirt/libvirt-sock': No such file or directory
+`,
+			nil,
+			[]int{0, 1},
+		},
+		{
+			"empty",
+			` Id    Name                           State
+----------------------------------------------------
+
+`,
+			nil,
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			domains, unrecognized := parseVirshList(test.output)
+			if !reflect.DeepEqual(domains, test.domains) {
+				t.Fatalf("parseVirshList() failed.\nGot:\n%#v\nExpected:\n%#v", domains, test.domains)
+			}
+			if !reflect.DeepEqual(unrecognized, test.unrecognized) {
+				t.Fatalf("parseVirshList() returned the wrong unrecognized lines.\nGot:\n%#v\nExpected:\n%#v", unrecognized, test.unrecognized)
+			}
+		})
+	}
+}
+
+func TestParseGuestState(t *testing.T) {
+	tests := []struct {
+		s     string
+		state GuestState
+		ok    bool
+	}{
+		{"running", GuestRunning, true},
+		{"shut off  ", GuestShutOff, true},
+		{"in  shutdown", GuestInShutdown, true},
+		{"shut", GuestState("shut"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.s, func(t *testing.T) {
+			state, ok := ParseGuestState(test.s)
+			if state != test.state || ok != test.ok {
+				t.Fatalf("ParseGuestState() failed.\nGot:\n%q %v\nExpected:\n%q %v", state, ok, test.state, test.ok)
+			}
+		})
+	}
+}
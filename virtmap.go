@@ -2,11 +2,11 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
+	"os"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // VHost is a virtual host which contains several virtual guests
@@ -14,21 +14,205 @@ import (
 type VHost struct {
 	State  string   `json:"state"`
 	Guests []string `json:"guests"`
+	// Why the guests couldn't be listed, and Ansible's error message.
+	// Both are empty for hosts which are up.
+	Status HostStatus `json:"status,omitempty"`
+	Error  string     `json:"error,omitempty"`
+	// Name of the Source the host was loaded from
+	Source string `json:"source,omitempty"`
+	// Time of the host's last report of its own guests
+	Reported *time.Time `json:"reported,omitempty"`
+	// Times the host was first and last seen in a source
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	// Set in responses when the host hasn't been seen for too long
+	Stale bool `json:"stale,omitempty"`
+	// From the metadata file
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// HostStatus is the detailed reachability of a virtual host
+type HostStatus string
+
+// Host statuses
+const (
+	HostUp             HostStatus = "up"
+	HostUnreachableDNS HostStatus = "unreachable-dns"
+	HostTimeout        HostStatus = "timeout"
+	HostAuthFailed     HostStatus = "auth-failed"
+	HostCommandFailed  HostStatus = "command-failed"
+	HostUnknown        HostStatus = "unknown"
+)
+
+// State returns the State of a host with the status.  A host whose
+// command failed is reachable so it is "up", even though its guests
+// are missing.
+func (s HostStatus) State() string {
+	if s == HostUp || s == HostCommandFailed {
+		return "up"
+	}
+	return "down"
+}
+
+// Description describes the status for messages
+func (s HostStatus) Description() string {
+	switch s {
+	case HostUp:
+		return "is up"
+	case HostUnreachableDNS:
+		return "could not be resolved"
+	case HostTimeout:
+		return "timed out"
+	case HostAuthFailed:
+		return "failed authentication"
+	case HostCommandFailed:
+		return "failed to run virsh"
+	}
+	return "failed for an unknown reason"
 }
 
 // VGuest is a virtual guest. Includes the name of its virtual host
-// State may be "running", "paused", or "shut" (i.e. shut down)
+// State is one of the GuestStates, e.g. "running" or "shut off",
 // as reported by "virsh list --all"
 type VGuest struct {
-	State string `json:"state"`
-	Host  string `json:"host"`
+	State GuestState `json:"state"`
+	Host  string     `json:"host"`
+	// Only known for guests read from libvirt
+	UUID      string `json:"uuid,omitempty"`
+	VCPUs     int    `json:"vcpus,omitempty"`
+	MemoryKiB uint64 `json:"memory_kib,omitempty"`
+	// Name of the Source the guest was loaded from
+	Source string `json:"source,omitempty"`
+	// All of the hosts of a guest defined on more than one, in which
+	// case Host and State are those of the running copy if there is one
+	Placements []Placement `json:"placements,omitempty"`
+	// Set when more than one copy is running
+	SplitBrain bool `json:"split_brain,omitempty"`
+	// As for a VHost
+	FirstSeen   *time.Time        `json:"first_seen,omitempty"`
+	LastSeen    *time.Time        `json:"last_seen,omitempty"`
+	Stale       bool              `json:"stale,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Placement is one of the hosts a guest is defined on
+type Placement struct {
+	Host   string     `json:"host"`
+	State  GuestState `json:"state"`
+	Source string     `json:"source,omitempty"`
+}
+
+// placements returns all of the places the guest is defined
+func (g VGuest) placements() []Placement {
+	if len(g.Placements) > 0 {
+		return g.Placements
+	}
+	return []Placement{{Host: g.Host, State: g.State, Source: g.Source}}
+}
+
+// placementOn returns the placement of the guest on the host, if it has one
+func (g VGuest) placementOn(host string) (Placement, bool) {
+	for _, p := range g.placements() {
+		if p.Host == host {
+			return p, true
+		}
+	}
+	return Placement{}, false
+}
+
+// runningHosts returns the hosts on which the guest is running
+func (g VGuest) runningHosts() []string {
+	var hosts []string
+	for _, p := range g.placements() {
+		if p.State == GuestRunning {
+			hosts = append(hosts, p.Host)
+		}
+	}
+	return hosts
+}
+
+// addPlacement records that the guest is also on the host of p,
+// making it the guest's primary host if it is the first running copy
+func (g *VGuest) addPlacement(p Placement) {
+	placements := g.placements()
+	for _, x := range placements {
+		if x.Host == p.Host {
+			return
+		}
+	}
+	g.Placements = append(placements, p)
+	sort.Slice(g.Placements, func(i, j int) bool { return g.Placements[i].Host < g.Placements[j].Host })
+	if g.State != GuestRunning && p.State == GuestRunning {
+		g.Host, g.State, g.Source = p.Host, p.State, p.Source
+	}
+	g.SplitBrain = len(g.runningHosts()) > 1
+}
+
+// withoutHost returns the guest without its placement on host.
+// ok is false if the guest has no other placement.
+func (g VGuest) withoutHost(host string) (x VGuest, ok bool) {
+	var rest []Placement
+	for _, p := range g.placements() {
+		if p.Host != host {
+			rest = append(rest, p)
+		}
+	}
+	if len(rest) == 0 {
+		return VGuest{}, false
+	}
+	x = g
+	x.Placements, x.SplitBrain = nil, false
+	if g.Host == host {
+		x.Host, x.State, x.Source = rest[0].Host, rest[0].State, rest[0].Source
+		x.UUID, x.VCPUs, x.MemoryKiB = "", 0, 0
+	}
+	for _, p := range rest {
+		x.addPlacement(p)
+	}
+	return x, true
+}
+
+// withoutHosts returns the guest without its placements on the hosts.
+// ok is false if the guest has no other placement.
+func (g VGuest) withoutHosts(hosts map[string]bool) (x VGuest, ok bool) {
+	x = g
+	for _, p := range g.placements() {
+		if !hosts[p.Host] {
+			continue
+		}
+		if x, ok = x.withoutHost(p.Host); !ok {
+			return VGuest{}, false
+		}
+	}
+	return x, true
 }
 
 // Vmap is the main virtual map type.  It contains a map of guests
 // and a map of hosts to support queries in either direction.
 type Vmap struct {
+	// Keyed by fully qualified domain name
 	Hosts  map[string]VHost  `json:"hosts"`
 	Guests map[string]VGuest `json:"guests"`
+	// Configured alternative names of nodes
+	Aliases map[string]string `json:"-"`
+	// The snapshot the map was restored from, until all of the sources load
+	Restored *SnapshotInfo `json:"restored_from_snapshot,omitempty"`
+	// Time the map was loaded from its Sources
+	Loaded  *time.Time   `json:"loaded,omitempty"`
+	Sources []SourceInfo `json:"sources,omitempty"`
+}
+
+// AmbiguousNameError is returned by Get when a short name
+// matches more than one node in the map
+type AmbiguousNameError struct {
+	Name       string
+	Candidates []string
+}
+
+func (e *AmbiguousNameError) Error() string {
+	return fmt.Sprintf("Node %s is ambiguous, candidates: %s", e.Name, strings.Join(e.Candidates, ", "))
 }
 
 // Length returns the total number of hosts in the map
@@ -38,54 +222,206 @@ func (v Vmap) Length() int {
 
 // Load Loads the Ansible output file and parses it into the Vmap
 func (v *Vmap) Load(ansibleOutputFilename string) error {
-	raw, err := ioutil.ReadFile(ansibleOutputFilename)
+	f, err := os.Open(ansibleOutputFilename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	x, _, err := ParseAnsibleReader(f)
 	if err != nil {
 		return err
 	}
-	x := ParseAnsibleOutput(raw)
 	v.Hosts, v.Guests = x.Hosts, x.Guests
 	return nil
 }
 
-// Get returns a host from the map.  The target host
-// may be a virtual host or a virtual guest.
-// nodeNotFoundErr is returned when the target is not in the map
-func (v Vmap) Get(target string) (*Vmap, error) {
+// hostNames returns the sorted names of the hosts in the map
+func (v Vmap) hostNames() []string {
+	names := make([]string, 0, len(v.Hosts))
+	for n := range v.Hosts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// guestNames returns the sorted names of the guests in the map
+func (v Vmap) guestNames() []string {
+	names := make([]string, 0, len(v.Guests))
+	for n := range v.Guests {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Merge adds the hosts and guests of other to the map.  Nodes already
+// in the map take precedence over those in other, though a guest found
+// on a different host in other gains a Placement there.  The guests of
+// other on a host already in the map are dropped, as the host's guests
+// are those of the source it was taken from.
+func (v *Vmap) Merge(other *Vmap) {
+	if v.Hosts == nil {
+		v.Hosts = make(map[string]VHost)
+	}
+	if v.Guests == nil {
+		v.Guests = make(map[string]VGuest)
+	}
+	taken := make(map[string]bool, len(v.Hosts))
+	for n := range v.Hosts {
+		taken[n] = true
+	}
+	for n, h := range other.Hosts {
+		if !taken[n] {
+			v.Hosts[n] = h
+		}
+	}
+	for n, g := range other.Guests {
+		g, ok := g.withoutHosts(taken)
+		if !ok {
+			continue
+		}
+		existing, ok := v.Guests[n]
+		if !ok {
+			v.Guests[n] = g
+			continue
+		}
+		for _, p := range g.placements() {
+			existing.addPlacement(p)
+		}
+		v.Guests[n] = existing
+	}
+}
+
+// Conflicts returns a new Vmap with only the guests which
+// are defined on more than one host
+func (v Vmap) Conflicts() *Vmap {
+	x := &Vmap{Guests: make(map[string]VGuest), Restored: v.Restored}
+	for n, g := range v.Guests {
+		if len(g.Placements) > 1 {
+			x.Guests[n] = g
+		}
+	}
+	return x
+}
+
+// setSource records source as the provenance of every node in the map
+func (v *Vmap) setSource(source string) {
+	for n, h := range v.Hosts {
+		h.Source = source
+		v.Hosts[n] = h
+	}
+	for n, g := range v.Guests {
+		g.Source = source
+		for i := range g.Placements {
+			g.Placements[i].Source = source
+		}
+		v.Guests[n] = g
+	}
+}
+
+// fromSource returns a new Vmap with only the nodes loaded from source
+func (v Vmap) fromSource(source string) *Vmap {
+	x := &Vmap{
+		Hosts:  make(map[string]VHost),
+		Guests: make(map[string]VGuest),
+	}
 	for n, h := range v.Hosts {
-		if n == target {
-			return &Vmap{Hosts: map[string]VHost{n: h}}, nil
+		if h.Source == source {
+			x.Hosts[n] = h
 		}
 	}
 	for n, g := range v.Guests {
-		if n == target {
-			return &Vmap{Guests: map[string]VGuest{n: g}}, nil
+		if g.Source == source {
+			x.Guests[n] = g
+		}
+	}
+	return x
+}
+
+// Get returns a host from the map.  The target host
+// may be a virtual host or a virtual guest.  Besides its full name,
+// a node may be found by an alias or by a short name, which is one or
+// more of the leading labels of its name, e.g. "kvm09" or "kvm09.dc1"
+// for "kvm09.dc1.example.com".
+// ErrNodeNotFound is returned when the target is not in the map
+// and an *AmbiguousNameError when a short name matches several nodes.
+func (v Vmap) Get(target string) (*Vmap, error) {
+	if result, ok := v.getExact(target); ok {
+		return result, nil
+	}
+	if name, ok := v.Aliases[target]; ok {
+		if result, ok := v.getExact(name); ok {
+			return result, nil
+		}
+	}
+	candidates := v.shortNameMatches(target)
+	switch len(candidates) {
+	case 0:
+		return nil, ErrNodeNotFound
+	case 1:
+		result, _ := v.getExact(candidates[0])
+		return result, nil
+	}
+	return nil, &AmbiguousNameError{Name: target, Candidates: candidates}
+}
+
+// getExact returns the node with exactly the given name
+func (v Vmap) getExact(name string) (*Vmap, bool) {
+	if h, ok := v.Hosts[name]; ok {
+		return &Vmap{Hosts: map[string]VHost{name: h}, Restored: v.Restored}, true
+	}
+	if g, ok := v.Guests[name]; ok {
+		return &Vmap{Guests: map[string]VGuest{name: g}, Restored: v.Restored}, true
+	}
+	return nil, false
+}
+
+// shortNameMatches returns the sorted names of the nodes
+// for which short is a short name
+func (v Vmap) shortNameMatches(short string) []string {
+	var matches []string
+	for n := range v.Hosts {
+		if strings.HasPrefix(n, short+".") {
+			matches = append(matches, n)
 		}
 	}
-	return nil, ErrNodeNotFound
+	for n := range v.Guests {
+		if strings.HasPrefix(n, short+".") {
+			matches = append(matches, n)
+		}
+	}
+	sort.Strings(matches)
+	return matches
 }
 
 // Info returns a friendly text string describing the target host.
 // Used in user cli queries.
 func (v *Vmap) Info(target string) string {
 	result, err := v.Get(target)
+	if e, ok := err.(*AmbiguousNameError); ok {
+		return fmt.Sprintf("Node %s is ambiguous, it may be: %s", target, strings.Join(e.Candidates, ", "))
+	}
 	if err != nil {
 		return fmt.Sprintf("Node %s not found", target)
 	}
 	var info string
-	if h, ok := result.Hosts[target]; ok {
-		info = fmt.Sprintf("%s is a virtual host for guests: %s", target, strings.Join(h.Guests, ", "))
+	for n, h := range result.Hosts {
+		info = fmt.Sprintf("%s is a virtual host for guests: %s", n, strings.Join(h.Guests, ", "))
 	}
-	if g, ok := result.Guests[target]; ok {
-		info = fmt.Sprintf("%s is a virtual guest on host: %s", target, g.Host)
+	for n, g := range result.Guests {
+		info = fmt.Sprintf("%s is a virtual guest on host: %s", n, g.Host)
 	}
 	return info
 }
 
 // SafeVmap is a Vmap wrapped with a mutex for the
-// server to use since Go maps are not thread safe
+// server to use since Go maps are not thread safe.
+// Diagnostics are those from the loading of the Vmap.
 type SafeVmap struct {
 	sync.RWMutex
 	Vmap
+	Diagnostics []Diagnostic
 }
 
 // Length for SafeVmap wraps Vmap.Length() in a read lock
@@ -103,6 +439,63 @@ func (s *SafeVmap) Load(ansibleOutputFilename string) error {
 	return s.Vmap.Load(ansibleOutputFilename)
 }
 
+// Replace for SafeVmap swaps in a new Vmap and its
+// Diagnostics under a (write) lock
+func (s *SafeVmap) Replace(v *Vmap, diags []Diagnostic) {
+	s.Lock()
+	defer s.Unlock()
+	s.Vmap = *v
+	s.Diagnostics = diags
+}
+
+// UpdateHost replaces everything the map has on one host with x, the map
+// of just that host, e.g. from the host's own report.  The guests in x take
+// precedence, though a guest also on other hosts keeps those placements.
+// The maps are copied rather than changed, as readers may still hold them.
+func (s *SafeVmap) UpdateHost(name string, x *Vmap) {
+	s.Lock()
+	defer s.Unlock()
+	rest := &Vmap{
+		Hosts:  make(map[string]VHost, len(s.Hosts)),
+		Guests: make(map[string]VGuest, len(s.Guests)),
+	}
+	for n, h := range s.Hosts {
+		if n != name {
+			rest.Hosts[n] = h
+		}
+	}
+	for n, g := range s.Guests {
+		if g, ok := g.withoutHost(name); ok {
+			rest.Guests[n] = g
+		}
+	}
+	v := &Vmap{
+		Hosts:    make(map[string]VHost, len(s.Hosts)),
+		Guests:   make(map[string]VGuest, len(s.Guests)),
+		Aliases:  s.Aliases,
+		Restored: s.Restored,
+		Loaded:   s.Loaded,
+		Sources:  s.Sources,
+	}
+	v.Merge(x)
+	v.Merge(rest)
+	s.Vmap = *v
+}
+
+// Conflicts for SafeVmap wraps Vmap.Conflicts() in a read lock
+func (s *SafeVmap) Conflicts() *Vmap {
+	s.RLock()
+	defer s.RUnlock()
+	return s.Vmap.Conflicts()
+}
+
+// GetDiagnostics returns the Diagnostics from loading the Vmap under a read lock
+func (s *SafeVmap) GetDiagnostics() []Diagnostic {
+	s.RLock()
+	defer s.RUnlock()
+	return s.Diagnostics
+}
+
 // Get for SafeVmap wraps Vmap.Get() in a read lock
 // s is a pointer receiver so we don't copy the mutex
 func (s *SafeVmap) Get(target string) (*Vmap, error) {
@@ -118,44 +511,3 @@ func (s *SafeVmap) Info(target string) string {
 	defer s.RUnlock()
 	return s.Vmap.Info(target)
 }
-
-// ParseAnsibleOutput parses the output of an Ansible run of
-// "virsh list --all" on all the virtual hosts
-func ParseAnsibleOutput(ansibleOutput []byte) *Vmap {
-	v := &Vmap{
-		Hosts:  make(map[string]VHost),
-		Guests: make(map[string]VGuest),
-	}
-	nodename := ""
-	for _, line := range strings.Split(string(ansibleOutput), "\n") {
-		// Ansible status lines contain the hostname and any connection errors
-		if strings.Contains(line, " | ") {
-			nodename = strings.Split(strings.Fields(line)[0], ".")[0]
-			if strings.Contains(line, "Name or service not known") {
-				continue
-			}
-			state := "up"
-			if strings.Contains(line, "FAILED: timed out") {
-				state = "down"
-			}
-			v.Hosts[nodename] = VHost{State: state}
-		}
-		if nodename != "" {
-			fields := strings.Fields(line)
-			if len(fields) == 0 {
-				continue
-			}
-			// Guest state lines
-			if _, err := strconv.Atoi(fields[0]); err == nil || fields[0] == "-" {
-				host := v.Hosts[nodename]
-				host.Guests = append(host.Guests, fields[1])
-				v.Hosts[nodename] = host
-				v.Guests[fields[1]] = VGuest{State: fields[2], Host: nodename}
-			}
-		}
-	}
-	for _, h := range v.Hosts {
-		sort.Strings(h.Guests)
-	}
-	return v
-}
@@ -25,21 +25,22 @@ kvm59.example.com | success | rc=0 >>
 `)
 
 func TestParseAnsibleOutput(t *testing.T) {
-	vmap := ParseAnsibleOutput(ansibleOutput)
+	vmap, _ := ParseAnsibleOutput(ansibleOutput)
 	if vmap.Length() == 0 {
 		t.Fatal("ParseAnsibleOutput() returned nothing")
 	}
 	expected := &Vmap{
 		Hosts: map[string]VHost{
-			"kvm09": VHost{"up", []string{"olh", "tam"}},
-			"kvm43": VHost{"up", []string{"compute-64"}},
-			"kvm30": VHost{"down", []string(nil)},
-			"kvm59": VHost{"up", []string(nil)},
+			"kvm09.example.com": VHost{State: "up", Guests: []string{"olh", "tam"}},
+			"kvm43.example.com": VHost{State: "up", Guests: []string{"compute-64"}},
+			"kvm21.example.com": VHost{State: "down", Guests: []string(nil), Status: HostUnreachableDNS, Error: "FAILED: [Errno -2] Name or service not known"},
+			"kvm30.example.com": VHost{State: "down", Guests: []string(nil), Status: HostTimeout, Error: "FAILED: timed out"},
+			"kvm59.example.com": VHost{State: "up", Guests: []string(nil)},
 		},
 		Guests: map[string]VGuest{
-			"tam":        VGuest{"running", "kvm09"},
-			"olh":        VGuest{"shut", "kvm09"},
-			"compute-64": VGuest{"paused", "kvm43"},
+			"tam":        VGuest{State: "running", Host: "kvm09.example.com"},
+			"olh":        VGuest{State: "shut off", Host: "kvm09.example.com"},
+			"compute-64": VGuest{State: "paused", Host: "kvm43.example.com"},
 		},
 	}
 	if !reflect.DeepEqual(vmap, expected) {
@@ -48,7 +49,7 @@ func TestParseAnsibleOutput(t *testing.T) {
 }
 
 func TestGet(t *testing.T) {
-	vmap := ParseAnsibleOutput(ansibleOutput)
+	vmap, _ := ParseAnsibleOutput(ansibleOutput)
 	tests := []struct {
 		target string
 		result *Vmap
@@ -57,7 +58,7 @@ func TestGet(t *testing.T) {
 		{
 			"kvm43",
 			&Vmap{
-				Hosts:  map[string]VHost{"kvm43": VHost{"up", []string{"compute-64"}}},
+				Hosts:  map[string]VHost{"kvm43.example.com": VHost{State: "up", Guests: []string{"compute-64"}}},
 				Guests: map[string]VGuest(nil),
 			},
 			"",
@@ -66,7 +67,7 @@ func TestGet(t *testing.T) {
 			"olh",
 			&Vmap{
 				Hosts:  map[string]VHost(nil),
-				Guests: map[string]VGuest{"olh": VGuest{"shut", "kvm09"}},
+				Guests: map[string]VGuest{"olh": VGuest{State: "shut off", Host: "kvm09.example.com"}},
 			},
 			"",
 		},
@@ -78,7 +79,7 @@ func TestGet(t *testing.T) {
 		{
 			"kvm59",
 			&Vmap{
-				Hosts:  map[string]VHost{"kvm59": VHost{"up", []string(nil)}},
+				Hosts:  map[string]VHost{"kvm59.example.com": VHost{State: "up", Guests: []string(nil)}},
 				Guests: map[string]VGuest(nil),
 			},
 			"",
@@ -102,15 +103,16 @@ func TestGet(t *testing.T) {
 }
 
 func TestInfo(t *testing.T) {
-	vmap := ParseAnsibleOutput(ansibleOutput)
+	vmap, _ := ParseAnsibleOutput(ansibleOutput)
 	tests := []struct {
 		node string
 		info string
 	}{
-		{"kvm09", "kvm09 is a virtual host for guests: olh, tam"},
-		{"tam", "tam is a virtual guest on host: kvm09"},
+		{"kvm09", "kvm09.example.com is a virtual host for guests: olh, tam"},
+		{"kvm09.example.com", "kvm09.example.com is a virtual host for guests: olh, tam"},
+		{"tam", "tam is a virtual guest on host: kvm09.example.com"},
 		{"gone", "Node gone not found"},
-		{"kvm59", "kvm59 is a virtual host for guests: "},
+		{"kvm59", "kvm59.example.com is a virtual host for guests: "},
 	}
 	for _, test := range tests {
 		t.Run(test.node, func(t *testing.T) {
@@ -124,3 +126,178 @@ func TestInfo(t *testing.T) {
 		})
 	}
 }
+
+func TestGetShortNames(t *testing.T) {
+	vmap := Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.dc1.example.com": VHost{State: "up", Guests: []string{"tam"}},
+			"kvm09.dc2.example.com": VHost{State: "up", Guests: []string{"olh"}},
+		},
+		Guests: map[string]VGuest{
+			"tam": VGuest{State: "running", Host: "kvm09.dc1.example.com"},
+			"olh": VGuest{State: "running", Host: "kvm09.dc2.example.com"},
+		},
+		Aliases: map[string]string{"kvm09-dc2": "kvm09.dc2.example.com"},
+	}
+	tests := []struct {
+		target string
+		host   string
+		error  string
+	}{
+		{"kvm09.dc1.example.com", "kvm09.dc1.example.com", ""},
+		{"kvm09.dc1", "kvm09.dc1.example.com", ""},
+		{"kvm09-dc2", "kvm09.dc2.example.com", ""},
+		{"kvm09", "", "Node kvm09 is ambiguous, candidates: kvm09.dc1.example.com, kvm09.dc2.example.com"},
+		{"kvm0", "", "Node not found"},
+	}
+	for _, test := range tests {
+		t.Run(test.target, func(t *testing.T) {
+			node, err := vmap.Get(test.target)
+			if test.error != "" {
+				if err == nil || err.Error() != test.error {
+					t.Fatalf("Get() returned the wrong error\nGot:\n%v\nExpected:\n%v", err, test.error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get() returned an error unexpectedly: %v", err)
+			}
+			if _, ok := node.Hosts[test.host]; !ok || len(node.Hosts) != 1 {
+				t.Fatalf("Get() returned the wrong node\nGot:\n%#v\nExpected:\n%v", node, test.host)
+			}
+		})
+	}
+	if info := vmap.Info("kvm09"); info != "Node kvm09 is ambiguous, it may be: kvm09.dc1.example.com, kvm09.dc2.example.com" {
+		t.Fatalf("Info() problem with an ambiguous name\nGot:\n%v", info)
+	}
+}
+
+func TestMergePlacements(t *testing.T) {
+	vmap := &Vmap{
+		Hosts: map[string]VHost{"kvm09.example.com": VHost{State: "up", Guests: []string{"tam", "olh"}}},
+		Guests: map[string]VGuest{
+			"tam": VGuest{State: "shut off", Host: "kvm09.example.com", Source: "dc1"},
+			"olh": VGuest{State: "running", Host: "kvm09.example.com", Source: "dc1"},
+		},
+	}
+	vmap.Merge(&Vmap{
+		Hosts: map[string]VHost{"kvm11.example.com": VHost{State: "up", Guests: []string{"tam", "olh"}}},
+		Guests: map[string]VGuest{
+			"tam": VGuest{State: "running", Host: "kvm11.example.com", Source: "dc2"},
+			"olh": VGuest{State: "running", Host: "kvm11.example.com", Source: "dc2"},
+		},
+	})
+	expected := map[string]VGuest{
+		"tam": VGuest{
+			State:  "running",
+			Host:   "kvm11.example.com",
+			Source: "dc2",
+			Placements: []Placement{
+				{Host: "kvm09.example.com", State: "shut off", Source: "dc1"},
+				{Host: "kvm11.example.com", State: "running", Source: "dc2"},
+			},
+		},
+		"olh": VGuest{
+			State:  "running",
+			Host:   "kvm09.example.com",
+			Source: "dc1",
+			Placements: []Placement{
+				{Host: "kvm09.example.com", State: "running", Source: "dc1"},
+				{Host: "kvm11.example.com", State: "running", Source: "dc2"},
+			},
+			SplitBrain: true,
+		},
+	}
+	if !reflect.DeepEqual(vmap.Guests, expected) {
+		t.Fatalf("Merge() failed.\nGot:\n%#v\nExpected:\n%#v", vmap.Guests, expected)
+	}
+	if conflicts := vmap.Conflicts(); !reflect.DeepEqual(conflicts.Guests, expected) {
+		t.Fatalf("Conflicts() failed.\nGot:\n%#v\nExpected:\n%#v", conflicts.Guests, expected)
+	}
+}
+
+func TestMergeTakenHost(t *testing.T) {
+	// kvm09 reported only tam, the file still has olh on it too
+	vmap := &Vmap{
+		Hosts:  map[string]VHost{"kvm09.example.com": VHost{State: "up", Guests: []string{"tam"}, Source: "report"}},
+		Guests: map[string]VGuest{"tam": VGuest{State: "running", Host: "kvm09.example.com", Source: "report"}},
+	}
+	vmap.Merge(&Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": VHost{State: "up", Guests: []string{"olh", "tam", "web01"}, Source: "dc1"},
+			"kvm11.example.com": VHost{State: "up", Guests: []string{"web01"}, Source: "dc1"},
+		},
+		Guests: map[string]VGuest{
+			"tam": VGuest{State: "running", Host: "kvm09.example.com", Source: "dc1"},
+			"olh": VGuest{State: "shut off", Host: "kvm09.example.com", Source: "dc1"},
+			"web01": VGuest{State: "running", Host: "kvm09.example.com", Source: "dc1", Placements: []Placement{
+				{Host: "kvm09.example.com", State: "running", Source: "dc1"},
+				{Host: "kvm11.example.com", State: "running", Source: "dc1"},
+			}, SplitBrain: true},
+		},
+	})
+	expected := &Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": VHost{State: "up", Guests: []string{"tam"}, Source: "report"},
+			"kvm11.example.com": VHost{State: "up", Guests: []string{"web01"}, Source: "dc1"},
+		},
+		Guests: map[string]VGuest{
+			"tam":   VGuest{State: "running", Host: "kvm09.example.com", Source: "report"},
+			"web01": VGuest{State: "running", Host: "kvm11.example.com", Source: "dc1"},
+		},
+	}
+	if !reflect.DeepEqual(vmap, expected) {
+		t.Fatalf("Merge() failed.\nGot:\n%#v\nExpected:\n%#v", vmap, expected)
+	}
+}
+
+func TestUpdateHost(t *testing.T) {
+	svmap := &SafeVmap{Vmap: Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": VHost{State: "up", Guests: []string{"olh", "tam"}, Source: "dc1"},
+			"kvm11.example.com": VHost{State: "up", Guests: []string{"olh"}, Source: "dc1"},
+		},
+		Guests: map[string]VGuest{
+			"tam": VGuest{State: "running", Host: "kvm09.example.com", Source: "dc1"},
+			"olh": VGuest{
+				State:  "running",
+				Host:   "kvm09.example.com",
+				Source: "dc1",
+				Placements: []Placement{
+					{Host: "kvm09.example.com", State: "running", Source: "dc1"},
+					{Host: "kvm11.example.com", State: "shut off", Source: "dc1"},
+				},
+			},
+		},
+	}}
+	old := svmap.Vmap
+	// tam has gone from kvm09 and db01 has arrived
+	svmap.UpdateHost("kvm09.example.com", &Vmap{
+		Hosts:  map[string]VHost{"kvm09.example.com": VHost{State: "up", Guests: []string{"db01", "olh"}, Source: "report"}},
+		Guests: map[string]VGuest{"db01": VGuest{State: "running", Host: "kvm09.example.com", Source: "report"}, "olh": VGuest{State: "paused", Host: "kvm09.example.com", Source: "report"}},
+	})
+	expected := Vmap{
+		Hosts: map[string]VHost{
+			"kvm09.example.com": VHost{State: "up", Guests: []string{"db01", "olh"}, Source: "report"},
+			"kvm11.example.com": VHost{State: "up", Guests: []string{"olh"}, Source: "dc1"},
+		},
+		Guests: map[string]VGuest{
+			"db01": VGuest{State: "running", Host: "kvm09.example.com", Source: "report"},
+			"olh": VGuest{
+				State:  "paused",
+				Host:   "kvm09.example.com",
+				Source: "report",
+				Placements: []Placement{
+					{Host: "kvm09.example.com", State: "paused", Source: "report"},
+					{Host: "kvm11.example.com", State: "shut off", Source: "dc1"},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(svmap.Vmap, expected) {
+		t.Fatalf("UpdateHost() failed.\nGot:\n%#v\nExpected:\n%#v", svmap.Vmap, expected)
+	}
+	if _, ok := old.Guests["tam"]; !ok {
+		t.Fatal("UpdateHost() changed the previous map")
+	}
+}
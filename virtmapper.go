@@ -13,10 +13,28 @@ const (
 
 // Configuration defaults
 const (
-	ListenAddress     = ":7474"
-	LogFile           = "/var/log/virtmapper"
-	RefreshInterval   = 60 // Minutes
-	AnsibleOutputFile = "/tmp/virtmapper.txt"
+	ListenAddress          = ":7474"
+	LogFile                = "/var/log/virtmapper"
+	RefreshInterval        = 60 // Minutes
+	AnsibleOutputFile      = "/tmp/virtmapper.txt"
+	WatchDebounce          = 2  // Seconds
+	WatchPollInterval      = 10 // Seconds
+	ReloadMaxShrink        = 50 // Percent
+	StateDir               = "/var/lib/virtmapper"
+	MigrationLogSize       = 1000
+	StaleAfter             = 180 // Minutes
+	HistoryRetention       = 90  // Days
+	HistoryCompactInterval = 24  // Hours
+
+	CollectCommand     = "ssh {host} virsh list --all"
+	CollectTimeout     = 30 // Seconds
+	CollectConcurrency = 10
+
+	AgentCommand   = "virsh list --all"
+	AgentInterval  = 60 // Seconds
+	AgentHeartbeat = 10 // Minutes
+	AgentRetries   = 5
+	AgentBackoff   = 1 // Seconds
 )
 
 func main() {
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// watchedSource is a Source read from the local filesystem, which
+// is reloaded as soon as its file or directory changes
+type watchedSource interface {
+	WatchPath() string
+}
+
+func (f *fileSource) WatchPath() string {
+	return f.path
+}
+
+func (t *treeSource) WatchPath() string {
+	return t.dir
+}
+
+// watchEvent is a change to one of the watched paths.  A change is
+// written once a file has been closed or moved into place, and a
+// change which isn't only shows that writing is still going on.
+type watchEvent struct {
+	path    string
+	written bool
+}
+
+// watcher watches the files and directories of sources for changes.
+// Changes are reported once writing has stopped for the debounce time,
+// so a file is only reloaded once it is complete.  Where the files can't
+// be watched, e.g. because the platform isn't supported by inotify or
+// fsnotify, they are polled instead.
+type watcher struct {
+	paths    []string
+	debounce time.Duration
+	poll     time.Duration
+}
+
+// newWatcher creates a watcher for those of the sources which are watchable
+func newWatcher(sources []Source, debounce, poll time.Duration) *watcher {
+	w := &watcher{debounce: debounce, poll: poll}
+	for _, src := range sources {
+		if ws, ok := src.(watchedSource); ok {
+			w.paths = append(w.paths, ws.WatchPath())
+		}
+	}
+	return w
+}
+
+// watch sends the paths which have changed on changes until done is closed
+func (w *watcher) watch(changes chan<- string, done chan struct{}) {
+	events, err := watchNotify(w.paths, done)
+	if err != nil {
+		log.Printf("Can't watch sources, polling them every %v instead: %v", w.poll, err)
+		events = w.pollEvents(done)
+	}
+	w.debounceEvents(events, changes, done)
+}
+
+// debounceEvents sends the paths written since the last send, separated by
+// commas, once no event has arrived for the debounce time
+func (w *watcher) debounceEvents(events <-chan watchEvent, changes chan<- string, done chan struct{}) {
+	written := make(map[string]bool)
+	var settled <-chan time.Time
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if e.written {
+				written[e.path] = true
+			}
+			if len(written) > 0 {
+				settled = time.After(w.debounce)
+			}
+		case <-settled:
+			paths := make([]string, 0, len(written))
+			for path := range written {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			written = make(map[string]bool)
+			settled = nil
+			select {
+			case changes <- strings.Join(paths, ", "):
+			case <-done:
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// pollEvents checks the paths for changes every poll interval.  A path is
+// written once it has changed and then stayed the same for an interval.
+func (w *watcher) pollEvents(done chan struct{}) <-chan watchEvent {
+	events := make(chan watchEvent)
+	go func() {
+		defer close(events)
+		last := make(map[string]string)
+		changing := make(map[string]bool)
+		for _, path := range w.paths {
+			last[path] = pollSignature(path)
+		}
+		for {
+			select {
+			case <-time.After(w.poll):
+			case <-done:
+				return
+			}
+			for _, path := range w.paths {
+				sig := pollSignature(path)
+				var e watchEvent
+				switch {
+				case sig != last[path]:
+					last[path] = sig
+					changing[path] = true
+					e = watchEvent{path: path}
+				case changing[path]:
+					delete(changing, path)
+					e = watchEvent{path: path, written: true}
+				default:
+					continue
+				}
+				select {
+				case events <- e:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
+
+// pollSignature returns a string which changes when the file or any
+// of the files in the directory at path is written, or is removed
+func pollSignature(path string) string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	files := []os.FileInfo{fi}
+	if fi.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return ""
+		}
+		files = append(files, entries...)
+	}
+	var sig strings.Builder
+	for _, f := range files {
+		fmt.Fprintf(&sig, "%s %d %d\n", f.Name(), f.ModTime().UnixNano(), f.Size())
+	}
+	return sig.String()
+}
@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// inotify events which show that a file is complete, and those which
+// only show that it is being written
+const (
+	inotifyWritten = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_DELETE | syscall.IN_MOVED_FROM
+	inotifyWriting = syscall.IN_MODIFY | syscall.IN_CREATE
+)
+
+// watchNotify watches the paths with inotify until done is closed.  The
+// directory of a file is watched rather than the file itself, so that
+// a file which is replaced by renaming another over it is still seen.
+// A file is written once it is closed after writing or moved into place,
+// so a file which is still open isn't read however long the writer pauses.
+func watchNotify(paths []string, done chan struct{}) (<-chan watchEvent, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// A non-blocking file is read through the runtime's poller,
+	// so closing it stops a pending read
+	f := os.NewFile(uintptr(fd), "inotify")
+	// The paths watched in each directory by name, where "" is any name
+	watched := make(map[int32]map[string]string)
+	for _, path := range paths {
+		dir, name := path, ""
+		if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+			dir, name = filepath.Dir(path), filepath.Base(path)
+		}
+		wd, err := syscall.InotifyAddWatch(fd, dir, inotifyWritten|inotifyWriting)
+		if err != nil {
+			f.Close()
+			return nil, &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+		}
+		if watched[int32(wd)] == nil {
+			watched[int32(wd)] = make(map[string]string)
+		}
+		watched[int32(wd)][name] = path
+	}
+
+	events := make(chan watchEvent)
+	go func() {
+		<-done
+		f.Close()
+	}()
+	go func() {
+		defer close(events)
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				nameBytes := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(raw.Len)]
+				off += syscall.SizeofInotifyEvent + int(raw.Len)
+				name := string(bytes.TrimRight(nameBytes, "\x00"))
+				written := raw.Mask&inotifyWritten != 0
+				var matched []string
+				if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+					// Events were lost, so anything may have changed
+					matched, written = paths, true
+				} else if path, ok := watched[raw.Wd][name]; ok {
+					matched = []string{path}
+				} else if path, ok := watched[raw.Wd][""]; ok && name != "" && name[0] != '.' {
+					matched = []string{path}
+				}
+				for _, path := range matched {
+					select {
+					case events <- watchEvent{path: path, written: written}:
+					case <-done:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcherOpenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "virtmapper.txt")
+	if err := ioutil.WriteFile(file, ansibleOutput, 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := &watcher{paths: []string{file}, debounce: 50 * time.Millisecond}
+	changes := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go w.watch(changes, done)
+	// Let the watcher start before changing anything
+	time.Sleep(100 * time.Millisecond)
+
+	// A file which is still open isn't reloaded, however long the writer pauses
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(ansibleOutput[:len(ansibleOutput)/2]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-changes:
+		t.Errorf("Got change %q while the file was open, expected none", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if _, err := f.Write(ansibleOutput[len(ansibleOutput)/2:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-changes:
+		if got != file {
+			t.Errorf("Got change %q, expected %q", got, file)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Got no change, expected %q", file)
+	}
+}
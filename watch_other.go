@@ -0,0 +1,88 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchNotify watches the paths with fsnotify, i.e. kqueue on the BSDs
+// and macOS, until done is closed.  The directory of a file is watched
+// rather than the file itself, so that a file which is replaced by
+// renaming another over it is still seen.  fsnotify doesn't tell when a
+// file is closed, so only a file which is created, renamed or removed is
+// written, and writing to a file in place only shows writing going on.
+func watchNotify(paths []string, done chan struct{}) (<-chan watchEvent, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// The paths watched in each directory by name, where "" is any name
+	watched := make(map[string]map[string]string)
+	for _, path := range paths {
+		dir, name := path, ""
+		if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+			dir, name = filepath.Dir(path), filepath.Base(path)
+		}
+		dir = filepath.Clean(dir)
+		if err := fw.Add(dir); err != nil {
+			fw.Close()
+			return nil, &os.PathError{Op: "watch", Path: dir, Err: err}
+		}
+		if watched[dir] == nil {
+			watched[dir] = make(map[string]string)
+		}
+		watched[dir][name] = path
+	}
+
+	events := make(chan watchEvent)
+	go func() {
+		defer close(events)
+		defer fw.Close()
+		for {
+			var matched []string
+			var written bool
+			select {
+			case e, ok := <-fw.Events:
+				if !ok {
+					return
+				}
+				if e.Op == fsnotify.Chmod {
+					continue
+				}
+				written = e.Op&(fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0
+				dir, name := filepath.Dir(e.Name), filepath.Base(e.Name)
+				if path, ok := watched[dir][name]; ok {
+					matched = []string{path}
+				} else if path, ok := watched[dir][""]; ok && name[0] != '.' {
+					matched = []string{path}
+				}
+			case err, ok := <-fw.Errors:
+				if !ok {
+					return
+				}
+				if err != fsnotify.ErrEventOverflow {
+					log.Printf("Problem watching sources: %v", err)
+					continue
+				}
+				// Events were lost, so anything may have changed
+				matched, written = paths, true
+			case <-done:
+				return
+			}
+			for _, path := range matched {
+				select {
+				case events <- watchEvent{path: path, written: written}:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
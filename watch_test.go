@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestNewWatcher(t *testing.T) {
+	sources, err := NewSources([]string{"/tmp/dc1.txt", "tree:/var/lib/virtmapper/tree", "http://ansible.example.com/dc2.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newWatcher(sources, time.Second, time.Second)
+	expected := []string{"/tmp/dc1.txt", "/var/lib/virtmapper/tree"}
+	if len(w.paths) != 2 || w.paths[0] != expected[0] || w.paths[1] != expected[1] {
+		t.Errorf("Got:\n%#v\nExpected:\n%#v", w.paths, expected)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtmapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "virtmapper.txt")
+	tree := filepath.Join(dir, "tree")
+	if err := ioutil.WriteFile(file, ansibleOutput, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(tree, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		start func(w *watcher, changes chan string, done chan struct{})
+	}{
+		{"watch", func(w *watcher, changes chan string, done chan struct{}) {
+			go w.watch(changes, done)
+		}},
+		{"poll", func(w *watcher, changes chan string, done chan struct{}) {
+			go w.debounceEvents(w.pollEvents(done), changes, done)
+		}},
+	}
+	for _, test := range tests {
+		w := &watcher{paths: []string{file, tree}, debounce: 50 * time.Millisecond, poll: 20 * time.Millisecond}
+		changes := make(chan string)
+		done := make(chan struct{})
+		test.start(w, changes, done)
+		// Let the watcher start before changing anything
+		time.Sleep(100 * time.Millisecond)
+
+		// Only inotify tells when a file written in place is closed
+		inPlace := test.name == "poll" || runtime.GOOS == "linux"
+		steps := []struct {
+			change   func() error
+			expected string
+			skip     bool
+		}{
+			{func() error { return ioutil.WriteFile(file, ansibleOutputProblems, 0644) }, file, !inPlace},
+			{func() error {
+				return ioutil.WriteFile(filepath.Join(tree, "kvm09.example.com"), []byte("{}"), 0644)
+			}, tree, false},
+			{func() error {
+				tmp := filepath.Join(dir, "tmp.txt")
+				if err := ioutil.WriteFile(tmp, ansibleOutput, 0644); err != nil {
+					return err
+				}
+				return os.Rename(tmp, file)
+			}, file, false},
+		}
+		for i, step := range steps {
+			if step.skip {
+				continue
+			}
+			if err := step.change(); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case got := <-changes:
+				if got != step.expected {
+					t.Errorf("%s step %d: got change %q, expected %q", test.name, i, got, step.expected)
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("%s step %d: got no change, expected %q", test.name, i, step.expected)
+			}
+		}
+		close(done)
+	}
+}
+
+func TestDebounceEvents(t *testing.T) {
+	w := &watcher{debounce: 50 * time.Millisecond}
+	events := make(chan watchEvent)
+	changes := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go w.debounceEvents(events, changes, done)
+
+	// Writing without a complete file doesn't cause a change
+	events <- watchEvent{path: "/tmp/virtmapper.txt"}
+	select {
+	case got := <-changes:
+		t.Errorf("Got change %q, expected none", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Events keep delaying the change until they stop
+	start := time.Now()
+	events <- watchEvent{path: "/tmp/virtmapper.txt", written: true}
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		events <- watchEvent{path: "/var/lib/virtmapper/tree", written: i == 4}
+	}
+	got := <-changes
+	if expected := "/tmp/virtmapper.txt, /var/lib/virtmapper/tree"; got != expected {
+		t.Errorf("Got change %q, expected %q", got, expected)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Got change after %v, expected it to wait for the events to stop", elapsed)
+	}
+}